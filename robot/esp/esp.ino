@@ -21,6 +21,10 @@ int ID = -1;
 unsigned long my_time;
 //unsigned short samples[2 * MAX_LR_MIC_SAMPLES];
 byte samples[2*2*MAX_LR_MIC_SAMPLES] = {0};
+boolean busy = false;           // inside motor_sig, only a stop is accepted
+boolean stop_requested = false; // server sent a stop mid-motion
+char pending_sig = 0;           // move queued by get_mov_data for loop()
+short pending_param = 0;
 
 // main stuff
 
@@ -42,6 +46,12 @@ void setup() {
 
 void loop() {
   server.handleClient();
+  if (pending_sig) {
+    // run outside any handler, motor_sig serves requests itself
+    char sig = pending_sig;
+    pending_sig = 0;
+    motor_sig(sig, pending_param);
+  }
 }
 
 // utility functions
@@ -219,6 +229,10 @@ void handle_not_found(){
 void get_loc_data(){
 //  String message = ""; message += millis();
 //  server.send(200, "text/plain", message);
+  if (busy) {
+    server.send(200, "text/plain", "busy\n");
+    return;
+  }
   String body = server.arg("plain");
   int comma = body.indexOf(',');
   unsigned short post_time = (unsigned short) body.substring(comma+1,body.indexOf(',', comma+1)).toInt();
@@ -236,9 +250,24 @@ void get_mov_data(){
   String body = server.arg("plain");
   unsigned short param = (unsigned short) body.substring(body.indexOf(',')+1).toInt();
   char sig = body.charAt(0);
-  if (sig == 'f' || sig == 'b' || sig == 'r') {
+  if (sig == 'x') {
+    // motor_sig keeps serving requests while the motors run (from loop,
+    // never from in here), and winds down as soon as it sees this
+    stop_requested = busy;
+    if (busy || pending_sig) {
+      // not yet, the /mov callback says when
+      server.send(200, "text/plain", "stopping\n");
+    } else {
+      server.send(200, "text/plain", "stopped\n");
+    }
+  } else if (busy) {
+    server.send(200, "text/plain", "busy\n");
+  } else if (sig == 'f' || sig == 'b' || sig == 'r') {
+    busy = true;
+    stop_requested = false;
+    pending_sig = sig;
+    pending_param = param;
     server.send(200, "text/plain", "Hello there! General Kenobi.\n");
-    motor_sig(sig, param);
   } else {
     server.send(200, "text/plain", "invalid command\n");
   }
@@ -340,7 +369,10 @@ void speaker_sig(unsigned short post_time, unsigned short delay_time) {
 void motor_sig(char sig, short param) {
   // if rotate,  param == degrees
   // if fwd/bak, param == travel distance
+  // called from loop(), so the server.handleClient() calls below are
+  // never nested in a request handler
   byte out_buf[5];
+  busy = true;
   if (sig == 'r') {
     memcpy(out_buf, &sig, 1);
     memcpy(out_buf+1, &param, sizeof(short));
@@ -351,7 +383,16 @@ void motor_sig(char sig, short param) {
     // wait for finish signal
     ((unsigned long *) out_buf)[0] = 0x00000000;
 //    send_debug(String(((unsigned long *) out_buf)[0]));
+    boolean stop_sent = false;
     while ((out_buf[0] ^ 0xf7) || (out_buf[1] ^ 0xf7)) {
+      server.handleClient();
+      if (stop_requested && !stop_sent) {
+        // nano stops turning and reports how far it got
+        byte stop_buf[5] = {'x', 0, 0, 0, 0};
+        Serial.write(stop_buf, 5);
+        Serial.flush();
+        stop_sent = true;
+      }
       if (Serial.available()) {
         out_buf[1] = out_buf[0];
         out_buf[0] = Serial.read();
@@ -370,6 +411,7 @@ void motor_sig(char sig, short param) {
     message += ",\"rot\":";
     message += ang;
     message += ",\"mov\":\"r\"}";
+    busy = false;
     send_mov(message);
   } else {
     if (sig == 'b') {
@@ -392,7 +434,7 @@ void motor_sig(char sig, short param) {
     float start_ult_dist = read_ult(10), curr_ult_dist, delta_distance = 0, c;
     // while within computation time
     // and have not traveled enough distance (fwd / bak)
-    while (millis() - start_time < max_computation && flag && sig != 'x') {
+    while (millis() - start_time < max_computation && flag && sig != 'x' && !stop_requested) {
       // compute distance to-go
       curr_ult_dist = read_ult(5);
       delta_distance = start_ult_dist - curr_ult_dist;
@@ -430,6 +472,7 @@ void motor_sig(char sig, short param) {
         flag = delta_distance < param;
       }
       delay(2*max_motor_time);
+      server.handleClient();
     }
     if (sig != 'x') {
       // stop motors
@@ -459,6 +502,7 @@ void motor_sig(char sig, short param) {
     message += ",\"end\":";
     message += read_ult(10);
     message += ",\"mov\":\"m\"}";
+    busy = false;
     send_mov(message);
   }
 }
@@ -188,17 +188,19 @@ void loc_listen(unsigned short listen_time, unsigned short delay_time) {
 }
 
 void move_straight(unsigned short max_time) {
-  byte buf[5];
+  byte buf[5] = {0};
   int param1, param2;
   unsigned long start_time = millis(), command_start_time;
   while (millis() - start_time < max_time && buf[0] != 'x') {
     while (Serial.available() >= 5) {
       // new command!
       Serial.readBytes(buf, 5);
+      if (buf[0] == 'x') break; // esp wants us to stop
       memcpy(&param1, buf+1, 2);
       memcpy(&param2, buf+3, 2);
       command_start_time = millis();
     }
+    if (buf[0] == 'x') break;
     if (millis() - command_start_time < param1) {
       // keep doing current command
       if (buf[0] == 'f') {
@@ -241,7 +243,13 @@ void move_rotate(short deg) {
   long prev_z = gyro_z(), curr_z = gyro_z();
   float curr_angle = 0; // starting angle always zero, goal to equal deg
   byte buf[sizeof(float)] = {0xf7,0xf7};
+  byte cmd[5] = {0};
   while(abs(curr_angle - deg) > rot_err && curr_time - start_time < 5000) {
+    if (Serial.available() >= 5) {
+      // esp wants us to stop
+      Serial.readBytes(cmd, 5);
+      if (cmd[0] == 'x') break;
+    }
     // take gyro_z reading
     prev_time = curr_time;
     curr_time = millis();
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// *** ACOUSTIC RANGING ***
+
+// every so often (and whenever a bot asks to be relocalized) the exploration
+// holds two bots where they are, has one play the tone for the other, and
+// folds the distance the tone travelled into both poses: it only pins down
+// how far apart they are, not which way, so the correction lands along the
+// line between them
+//  -- the pair is the most uncertain bot and the surest of the others
+//  -- ranges that disagree with both poses by more than rangeGate sigmas are
+//     taken for bad correlations and dropped
+
+var (
+	rangeEvery    time.Duration = 2 * time.Minute  // 0 only ranges bots that need relocalizing
+	rangeCooldown time.Duration = 15 * time.Second // least time between two ranges asked for by relocalize
+	rangeSigma    float64       = 15               // cm, acoustic range noise
+	rangeGate     float64       = 3
+	rangeMax      float64       = 1000 // cm, farther than the tone carries
+	rangeDelay    int64         = 500  // ms the listener waits before recording, as in localize
+
+	locTimeout   time.Duration = 10 * time.Second // longest to wait on both /loc posts
+	acousticLock sync.Mutex                       // one tone in the air at a time, and loc is shared
+
+	rangeWanted = make(map[int]bool) // [botID] -> asked for a range by relocalize
+)
+
+// drainLoc drops /loc posts nobody is waiting on anymore
+func drainLoc() {
+	for {
+		select {
+		case <-loc:
+		default:
+			return
+		}
+	}
+}
+
+// acousticRange has speaker play the tone for listener and returns how far
+// apart they are, in cm; both bots must be standing still
+func acousticRange(listener, speaker int) (float64, error) {
+	spd, lpd, _, err := listenAndSpeak(rangeDelay, listener, speaker)
+	if err != nil {
+		return 0, err
+	}
+	lpd.formatSamples()
+	if len(lpd.left) == 0 || lpd.Total == 0 {
+		return 0, fmt.Errorf("bot %v recorded no samples", listener)
+	}
+	stateLock.RLock()
+	lpd.sOffset = speakerIndex(lpd, spd, listener, speaker, calibrationOf(speaker).OnsetMs)
+	stateLock.RUnlock()
+	// the mics sit either side of the bot, their average is its center
+	d := (xcorr(tone, lpd.left, lpd.sOffset) + xcorr(tone, lpd.right, lpd.sOffset)) / 2
+	if d <= 0 || d > rangeMax {
+		return 0, fmt.Errorf("bots %v and %v ranged %.1f cm apart, ignoring", listener, speaker, d)
+	}
+	return d, nil
+}
+
+// fuseRange corrects bots a and b by the range z between them, each
+// against the other's pose from before the correction (caller must hold
+// stateLock)
+func fuseRange(a, b int, z float64) {
+	pa, pb := pos[a], pos[b]
+	Pa, Pb := poseCovs[a], poseCovs[b]
+	fused := 0
+	for _, f := range []struct {
+		id    int
+		other pose
+		P     covariance
+	}{{a, pb, Pb}, {b, pa, Pa}} {
+		if err := activeEstimator.Range(f.id, f.other, f.P, z); err != nil {
+			fmt.Printf("  bot %v: %v\n", f.id, err)
+			continue
+		}
+		fused++
+	}
+	if fused > 0 {
+		fmt.Printf("  bots %v and %v: %.1f cm apart, now at %v and %v.\n", a, b, z, pos[a], pos[b])
+		publishFix(a, "range")
+		publishFix(b, "range")
+	}
+}
+
+// rangeFit is how a range to another bot fits a bot's pose
+type rangeFit struct {
+	u        [3]float64 // direction from the other bot, the only one a range corrects
+	Pu       [3]float64 // pose covariance times u
+	otherVar float64    // the other bot's position variance along u
+	S        float64    // innovation variance
+	nu       float64    // innovation, the range minus the expected one
+}
+
+// fitRange compares range z to a bot at other (with covariance otherP)
+// against botID's pose, refusing ranges too far off to trust (caller must
+// hold stateLock)
+func fitRange(botID int, other pose, otherP covariance, z float64) (rangeFit, error) {
+	p := pos[botID]
+	P := poseCovs[botID]
+	dx, dy := p.x-other.x, p.y-other.y
+	h := math.Hypot(dx, dy)
+	if h < 1 {
+		return rangeFit{}, fmt.Errorf("on top of the other bot, no direction to correct along")
+	}
+	rf := rangeFit{u: [3]float64{dx / h, dy / h, 0}, nu: z - h}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			rf.Pu[i] += P[i][j] * rf.u[j]
+		}
+	}
+	u := rf.u
+	rf.otherVar = u[0]*(otherP[0][0]*u[0]+otherP[0][1]*u[1]) + u[1]*(otherP[1][0]*u[0]+otherP[1][1]*u[1])
+	rf.S = u[0]*rf.Pu[0] + u[1]*rf.Pu[1] + rf.otherVar + rangeSigma*rangeSigma
+	if rf.nu*rf.nu > rangeGate*rangeGate*rf.S {
+		return rangeFit{}, fmt.Errorf("range %.1f cm is %.1f sigmas off the %.1f cm expected, ignoring", z, math.Abs(rf.nu)/math.Sqrt(rf.S), h)
+	}
+	return rf, nil
+}
+
+// acousticRelocalize asks the exploration to range botID against another
+// bot; a single range only fixes one direction, so it never counts as
+// relocalized by itself (caller must hold stateLock)
+func acousticRelocalize(botID int) bool {
+	if len(pos) > 1 {
+		rangeWanted[botID] = true
+	}
+	return false
+}
+
+// rangePartner is the bot (other than botID) surest of its pose
+// (caller must hold stateLock)
+func rangePartner(botID int) (int, bool) {
+	best, found := 0, false
+	for id := range pos {
+		if id == botID || id >= len(botStates) || botStates[id] == stateFailed {
+			continue
+		}
+		if !found || positionSigma(id) < positionSigma(best) {
+			best, found = id, true
+		}
+	}
+	return best, found
+}
+
+// maybeRange starts a range for a bot that asked for one, or a periodic
+// one for the most uncertain bot (runs on the dispatch loop)
+func (run *exploration) maybeRange() {
+	if run.ranging || run.paused {
+		return
+	}
+	stateLock.Lock()
+	a, ok := -1, false
+	if time.Since(run.ranged) >= rangeCooldown {
+		for id := range rangeWanted {
+			if !ok || id < a {
+				a, ok = id, true
+			}
+		}
+	}
+	if ok {
+		delete(rangeWanted, a)
+	} else if rangeEvery > 0 && time.Since(run.ranged) >= rangeEvery {
+		for id := range pos {
+			if id >= len(botStates) || botStates[id] == stateFailed {
+				continue
+			}
+			if !ok || positionSigma(id) > positionSigma(a) {
+				a, ok = id, true
+			}
+		}
+	}
+	b, found := 0, false
+	if ok {
+		b, found = rangePartner(a)
+	}
+	stateLock.Unlock()
+	if !found {
+		return
+	}
+	run.ranging = true
+	run.ranged = time.Now()
+	run.held[a] = true
+	run.held[b] = true
+	fmt.Printf("  holding bots %v and %v to range them.\n", a, b)
+	run.wg.Add(1)
+	go run.rangePair(a, b)
+}
+
+// rangePair waits for the held bots a and b to stand still, ranges them
+// and lets them go again
+func (run *exploration) rangePair(a, b int) {
+	defer run.wg.Done()
+	defer run.do(func(run *exploration) {
+		run.ranging = false
+		delete(run.held, a)
+		delete(run.held, b)
+		if run.paused {
+			return
+		}
+		for _, id := range []int{a, b} {
+			if mpd, ok := run.parked[id]; ok {
+				delete(run.parked, id)
+				run.handle(mpd)
+			}
+		}
+	})
+	deadline := time.Now().Add(movTimeout)
+	for !run.atRest(a, b) {
+		if time.Now().After(deadline) {
+			fmt.Printf("  bots %v and %v did not come to rest, not ranging.\n", a, b)
+			return
+		}
+		select {
+		case <-run.ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	z, err := acousticRange(a, b)
+	if err != nil {
+		fmt.Printf(" acousticRange error -- %v\n", err)
+		publishError(a, err.Error())
+		return
+	}
+	stateLock.Lock()
+	fuseRange(a, b, z)
+	stateLock.Unlock()
+}
+
+// atRest reports whether every bot in ids is parked, or idle with nothing
+// coming that would move it
+func (run *exploration) atRest(ids ...int) bool {
+	parked := make(map[int]bool)
+	done := make(chan struct{})
+	if run.do(func(run *exploration) {
+		for _, id := range ids {
+			_, parked[id] = run.parked[id]
+		}
+		close(done)
+	}) != nil {
+		return false
+	}
+	<-done
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	for _, id := range ids {
+		if !parked[id] && botStates[id] != stateIdle {
+			return false
+		}
+	}
+	return true
+}
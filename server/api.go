@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// *** QUERY API ***
+
+// read-only JSON views of the state: GET /bots, /bots/{id},
+// /bots/{id}/trajectory, /bots/{id}/diagnostics, /bots/{id}/calibration,
+// /map and /localization.
+// Errors are JSON too, {"error": "...", "status": 404}
+
+type apiError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func newAPIError(status int, format string, a ...interface{}) apiError {
+	return apiError{Error: fmt.Sprintf(format, a...), Status: status}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, newAPIError(status, format, a...))
+}
+
+// onlyGET answers 405 to anything but GET, reporting whether it did
+func onlyGET(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" {
+		return false
+	}
+	w.Header().Set("Allow", "GET")
+	writeError(w, http.StatusMethodNotAllowed, "%v not allowed, only GET", r.Method)
+	return true
+}
+
+// bot json
+type botInfo struct {
+	ID         int        `json:"id"`
+	IP         string     `json:"ip"`
+	Clock      int64      `json:"clock"` // server time minus bot time, ms
+	State      string     `json:"state"`
+	Pose       pose       `json:"pose"`
+	Cov        covariance `json:"cov"`
+	SigmaXY    float64    `json:"sigmaxy"` // cm
+	Lost       bool       `json:"lost"`
+	Path       []cell     `json:"path"`
+	Trajectory int        `json:"trajectory"` // poses recorded so far
+}
+
+// botInfoOf describes botID (caller must hold stateLock)
+func botInfoOf(botID int) botInfo {
+	bi := botInfo{ID: botID, IP: bot[botID], Path: []cell{}}
+	if botID < len(clocks) {
+		bi.Clock = clocks[botID]
+	}
+	if botID < len(botStates) {
+		bi.State = botStates[botID].String()
+	}
+	if botID < len(pos) {
+		bi.Pose = pos[botID]
+		bi.Cov = poseCovs[botID]
+		bi.SigmaXY = positionSigma(botID)
+		bi.Lost = lost[botID]
+	}
+	if botID < len(paths) {
+		bi.Path = append(bi.Path, paths[botID]...)
+	}
+	if botID < len(traj) {
+		bi.Trajectory = len(traj[botID])
+	}
+	return bi
+}
+
+func handleBots(w http.ResponseWriter, r *http.Request) {
+	if onlyGET(w, r) {
+		return
+	}
+	stateLock.RLock()
+	bis := []botInfo{}
+	for id := range bot {
+		bis = append(bis, botInfoOf(id))
+	}
+	stateLock.RUnlock()
+	writeJSON(w, http.StatusOK, bis)
+}
+
+// handleBot serves /bots/{id}, /bots/{id}/trajectory,
+// /bots/{id}/diagnostics and /bots/{id}/calibration, and hands the checks
+// of diagnostics.go, calibration.go and onset.go on
+func handleBot(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/bots/"), "/"), "/")
+	botID, err := strconv.Atoi(parts[0])
+	if len(parts) == 2 && diagChecks[parts[1]] != nil {
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bot ID %q is not a number", parts[0])
+			return
+		}
+		handleDiagnostic(w, r, botID, parts[1])
+		return
+	}
+	if len(parts) == 2 && (parts[1] == "calibrate" || (parts[1] == "calibration" && r.Method == "POST")) {
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bot ID %q is not a number", parts[0])
+			return
+		}
+		handleCalibrate(w, r, botID, parts[1])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "onset" {
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bot ID %q is not a number", parts[0])
+			return
+		}
+		handleOnset(w, r, botID)
+		return
+	}
+	if onlyGET(w, r) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bot ID %q is not a number", parts[0])
+		return
+	}
+	status, body := botResource(botID, parts[1:], r)
+	writeJSON(w, status, body)
+}
+
+// botResource looks up /bots/{botID}/{rest...}, returning the status and
+// body to answer with
+func botResource(botID int, rest []string, r *http.Request) (int, interface{}) {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	if botID < 0 || botID >= len(bot) {
+		return http.StatusNotFound, newAPIError(http.StatusNotFound, "no bot %v (%v registered)", botID, len(bot))
+	}
+	switch {
+	case len(rest) == 0:
+		return http.StatusOK, botInfoOf(botID)
+	case len(rest) == 1 && rest[0] == "trajectory":
+		// ?since=N skips the first N poses, for polling
+		since := 0
+		if q := r.URL.Query().Get("since"); q != "" {
+			var err error
+			if since, err = strconv.Atoi(q); err != nil || since < 0 {
+				return http.StatusBadRequest, newAPIError(http.StatusBadRequest, "since %q is not a pose count", q)
+			}
+		}
+		poses := []pose{}
+		if botID < len(traj) && since < len(traj[botID]) {
+			poses = append(poses, traj[botID][since:]...)
+		}
+		return http.StatusOK, map[string]interface{}{"id": botID, "since": since, "poses": poses}
+	case len(rest) == 1 && rest[0] == "diagnostics":
+		return http.StatusOK, diagnosticsOf(botID)
+	case len(rest) == 1 && rest[0] == "calibration":
+		return http.StatusOK, botCalibration{ID: botID, calibration: calibrationOf(botID)}
+	}
+	return http.StatusNotFound, newAPIError(http.StatusNotFound, "no such resource %v", r.URL.Path)
+}
+
+// map json
+type mapInfo struct {
+	XScale    float64     `json:"xscale"` // cm per cell
+	YScale    float64     `json:"yscale"` // cm per cell
+	Min       cell        `json:"min"`    // inclusive bounding box, cells
+	Max       cell        `json:"max"`
+	Width     int         `json:"width"`
+	Height    int         `json:"height"`
+	OccThresh float64     `json:"occthresh"` // log-odds at or over this is a wall
+	Known     float64     `json:"known"`     // |log-odds| under this is unknown
+	Cells     []cellValue `json:"cells,omitempty"`
+	Grid      [][]float64 `json:"grid,omitempty"` // [y - min.y][x - min.x] log-odds, with ?dense=1
+}
+
+func handleMap(w http.ResponseWriter, r *http.Request) {
+	if onlyGET(w, r) {
+		return
+	}
+	dense := r.URL.Query().Get("dense")
+	if dense != "" && dense != "0" && dense != "1" {
+		writeError(w, http.StatusBadRequest, "dense %q is not 0 or 1", dense)
+		return
+	}
+	stateLock.RLock()
+	mi := mapInfo{XScale: xscale, YScale: yscale, OccThresh: occThresh, Known: knownThresh}
+	first := true
+	for c := range ogm {
+		if first {
+			mi.Min, mi.Max, first = c, c, false
+		}
+		if c.x < mi.Min.x {
+			mi.Min.x = c.x
+		}
+		if c.y < mi.Min.y {
+			mi.Min.y = c.y
+		}
+		if c.x > mi.Max.x {
+			mi.Max.x = c.x
+		}
+		if c.y > mi.Max.y {
+			mi.Max.y = c.y
+		}
+	}
+	if !first {
+		mi.Width, mi.Height = mi.Max.x-mi.Min.x+1, mi.Max.y-mi.Min.y+1
+	}
+	if dense == "1" {
+		mi.Grid = make([][]float64, mi.Height)
+		for j := range mi.Grid {
+			mi.Grid[j] = make([]float64, mi.Width)
+			for i := range mi.Grid[j] {
+				mi.Grid[j][i] = ogm[cell{x: mi.Min.x + i, y: mi.Min.y + j}]
+			}
+		}
+	} else {
+		mi.Cells = []cellValue{}
+		for c, l := range ogm {
+			mi.Cells = append(mi.Cells, cellValue{X: c.x, Y: c.y, L: l})
+		}
+		sort.Slice(mi.Cells, func(i, j int) bool {
+			if mi.Cells[i].X != mi.Cells[j].X {
+				return mi.Cells[i].X < mi.Cells[j].X
+			}
+			return mi.Cells[i].Y < mi.Cells[j].Y
+		})
+	}
+	stateLock.RUnlock()
+	writeJSON(w, http.StatusOK, mi)
+}
+
+// localization json
+type botLocalization struct {
+	botUncertainty
+	Lost  bool       `json:"lost"`
+	Frame *gridFrame `json:"frame,omitempty"` // where its own grid sits, see /map/merge
+}
+
+type localizationInfo struct {
+	Localized bool              `json:"localized"`
+	Estimator string            `json:"estimator"`
+	Leader    int               `json:"leader"`   // poses are in this bot's starting frame
+	Localize  int               `json:"localize"` // most bots POST /localize takes
+	Clocks    []int64           `json:"clocks"`   // [botID] -> server time minus bot time, ms
+	Bots      []botLocalization `json:"bots"`
+}
+
+func handleLocalization(w http.ResponseWriter, r *http.Request) {
+	if onlyGET(w, r) {
+		return
+	}
+	stateLock.RLock()
+	li := localizationInfo{
+		Localized: localized,
+		Estimator: defaultEstimator,
+		Localize:  localizeLimit(),
+		Clocks:    append([]int64{}, clocks...),
+		Bots:      []botLocalization{},
+	}
+	for id := range pos {
+		bl := botLocalization{botUncertainty: uncertaintyOf(id), Lost: lost[id]}
+		if f, ok := frames[id]; ok {
+			bl.Frame = &f
+		}
+		li.Bots = append(li.Bots, bl)
+	}
+	stateLock.RUnlock()
+	writeJSON(w, http.StatusOK, li)
+}
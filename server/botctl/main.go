@@ -0,0 +1,735 @@
+// botctl drives the fleet through the server's API, eg:
+//
+//	botctl bots
+//	botctl localize 3
+//	botctl explore -duration 60 -policy frontier -param lambda=0.5
+//	botctl stop
+//	botctl estop [clear|status]
+//	botctl beep 1 440
+//	botctl move 1 f 10
+//	botctl ultrasonic 1
+//	botctl checks
+//	botctl calibrate 1
+//	botctl onset 1 0 100
+//	botctl export-map -o map.png
+//
+// -json prints what the server answered as JSON instead of a summary
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	server  = "http://localhost:42"
+	asJSON  = false
+	timeout = 30 * time.Second
+	client  = &http.Client{}
+)
+
+// what GET /bots answers with, the parts printed
+type botInfo struct {
+	ID    int    `json:"id"`
+	IP    string `json:"ip"`
+	State string `json:"state"`
+	Pose  struct {
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
+		R float64 `json:"r"`
+	} `json:"pose"`
+	SigmaXY    float64           `json:"sigmaxy"`
+	Lost       bool              `json:"lost"`
+	Path       []json.RawMessage `json:"path"`
+	Trajectory int               `json:"trajectory"`
+}
+
+type runStatus struct {
+	ID       int     `json:"id"`
+	Policy   string  `json:"policy"`
+	Started  int64   `json:"started"`
+	Duration float64 `json:"duration"`
+	Paused   bool    `json:"paused"`
+	Parked   []int   `json:"parked"`
+	Running  bool    `json:"running"`
+}
+
+// a plain text answer, for -json
+type reply struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type command struct {
+	args string // usage
+	help string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"bots":       {"", "list the registered bots", listBots},
+	"localize":   {"[n]", "localize the first n bots (as many as the server takes by default)", localize},
+	"explore":    {"[-duration s] [-policy p] [-param k=v ...]", "start an exploration", explore},
+	"stop":       {"[run]", "stop the exploration", stop},
+	"estop":      {"[clear|status]", "emergency stop every bot, allow motion again, or show which", estop},
+	"beep":       {"<id> [hz]", "beep a bot", beep},
+	"move":       {"<id> f|b|r|x <amount>", "jog a bot: cm forward or back, degrees to turn, x to stop", move},
+	"ultrasonic": {"<id> [readings]", "read a bot's ultrasonic sensor, cm", ultrasonic},
+	"checks":     {"[id]", "list the beeps, readings and moves checked so far", checks},
+	"calibrate":  {"[-moves cm,...] [-angles deg,...] [-rounds n] <id> | -show", "self-test a bot facing a wall and fit its movement scales", calibrate},
+	"onset":      {"[-rounds n] <id> <listener> <cm>", "time how late a bot's tone starts, speaking to a bot cm away", onset},
+	"export-map": {"[-o file] [-format png|json]", "save the map", exportMap},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: botctl [-server url] [-json] <command> [args]\n\ncommands:\n")
+	names := []string{"bots", "localize", "explore", "stop", "estop", "beep", "move", "ultrasonic", "checks", "calibrate", "onset", "export-map"}
+	tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(tw, "  %v %v\t%v\n", name, c.args, c.help)
+	}
+	tw.Flush()
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	if env := os.Getenv("BOTCTL_SERVER"); env != "" {
+		server = env
+	}
+	flag.StringVar(&server, "server", server, "server `url` (or $BOTCTL_SERVER)")
+	flag.BoolVar(&asJSON, "json", asJSON, "print JSON instead of a summary")
+	flag.DurationVar(&timeout, "timeout", timeout, "how long to wait for the server")
+	flag.Usage = usage
+	flag.Parse()
+	client.Timeout = timeout
+	server = strings.TrimRight(server, "/")
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "botctl: unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "botctl %v: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// *** TALKING TO THE SERVER ***
+
+// httpError is an answer outside 2xx
+type httpError struct {
+	status int
+	msg    string
+	body   []byte
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%v %v", e.status, e.msg)
+}
+
+// do sends body (if any) to url and returns what came back, failing on
+// anything but a 2xx
+func do(method, url string, body []byte) ([]byte, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, rd)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// the json api answers {"error": ...}, the rest plain text
+		apiErr := struct {
+			Error string `json:"error"`
+		}{}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+			msg = apiErr.Error
+		}
+		return nil, &httpError{status: resp.StatusCode, msg: msg, body: b}
+	}
+	return b, nil
+}
+
+func get(path string) ([]byte, error) {
+	return do("GET", server+path, nil)
+}
+
+func post(path, body string) ([]byte, error) {
+	return do("POST", server+path, []byte(body))
+}
+
+// getJSON decodes GET path into v
+func getJSON(path string, v interface{}) error {
+	b, err := get(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// printText prints a plain text answer, as {"status", "message"} with -json
+func printText(b []byte) error {
+	msg := strings.TrimSpace(string(b))
+	if asJSON {
+		return printJSON(reply{Status: http.StatusOK, Message: msg})
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printRun prints a run as the /explore endpoints answer it
+func printRun(b []byte) error {
+	run := runStatus{}
+	if err := json.Unmarshal(b, &run); err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(run)
+	}
+	state := "stopped"
+	switch {
+	case run.Running && run.Paused:
+		state = "paused"
+	case run.Running:
+		state = "running"
+	}
+	dur := "until stopped"
+	if run.Duration > 0 {
+		dur = fmt.Sprintf("for %vs", run.Duration)
+	}
+	fmt.Printf("exploration %v (%v) %v, %v\n", run.ID, run.Policy, state, dur)
+	if len(run.Parked) > 0 {
+		fmt.Printf("  parked: %v\n", run.Parked)
+	}
+	return nil
+}
+
+// botArg reads a bot ID
+func botArg(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("bot ID %q is not a number", s)
+	}
+	return id, nil
+}
+
+// *** COMMANDS ***
+
+func listBots(args []string) error {
+	var bots []botInfo
+	b, err := get("/bots")
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	if err := json.Unmarshal(b, &bots); err != nil {
+		return err
+	}
+	if len(bots) == 0 {
+		fmt.Println("no bots registered")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tIP\tSTATE\tX\tY\tR\tSIGMA\tWAYPOINTS\tPOSES")
+	for _, bi := range bots {
+		state := bi.State
+		if bi.Lost {
+			state += " (lost)"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.0f\t%.0f\t%.0f\t%.1f\t%v\t%v\n",
+			bi.ID, bi.IP, state, bi.Pose.X, bi.Pose.Y, bi.Pose.R, bi.SigmaXY, len(bi.Path), bi.Trajectory)
+	}
+	return tw.Flush()
+}
+
+func localize(args []string) error {
+	n := ""
+	switch len(args) {
+	case 0:
+		// as many as the server takes
+		li := struct {
+			Localize int `json:"localize"`
+		}{}
+		if err := getJSON("/localization", &li); err != nil {
+			return err
+		}
+		if li.Localize < 2 {
+			return fmt.Errorf("localizing takes at least 2 registered bots, the server takes %v", li.Localize)
+		}
+		n = strconv.Itoa(li.Localize)
+	case 1:
+		n = args[0]
+	default:
+		return fmt.Errorf("takes at most one argument, the number of bots")
+	}
+	b, err := post("/localize", n)
+	if err != nil {
+		return err
+	}
+	return printText(b)
+}
+
+// params collects repeated -param k=v flags
+type params map[string]float64
+
+func (p params) String() string {
+	return fmt.Sprint(map[string]float64(p))
+}
+
+func (p params) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	v, err := strconv.ParseFloat(kv[1], 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", kv[1])
+	}
+	p[kv[0]] = v
+	return nil
+}
+
+func explore(args []string) error {
+	fs := flag.NewFlagSet("explore", flag.ContinueOnError)
+	duration := fs.Float64("duration", 60, "seconds to explore for, 0 until stopped")
+	policy := fs.String("policy", "", "exploration policy (the server's default when empty)")
+	ps := params{}
+	fs.Var(ps, "param", "policy parameter `name=value`, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	req := map[string]interface{}{"duration": *duration}
+	if *policy != "" {
+		req["policy"] = *policy
+	}
+	if len(ps) > 0 {
+		req["params"] = ps
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	b, err := post("/explore/start", string(body))
+	if err != nil {
+		return err
+	}
+	return printRun(b)
+}
+
+func stop(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("takes at most one argument, the run ID")
+	}
+	b, err := post("/explore/stop", strings.Join(args, ""))
+	if err != nil {
+		return err
+	}
+	return printRun(b)
+}
+
+func estop(args []string) error {
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	var b []byte
+	var err error
+	switch sub {
+	case "":
+		b, err = post("/estop", "")
+	case "clear":
+		b, err = post("/estop/clear", "")
+	case "status":
+		b, err = get("/estop")
+	default:
+		return fmt.Errorf("unknown %q, want clear or status", sub)
+	}
+	if err != nil {
+		return err
+	}
+	return printText(b)
+}
+
+func beep(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("want <id> [hz]")
+	}
+	id, err := botArg(args[0])
+	if err != nil {
+		return err
+	}
+	return check(id, "beep", strings.Join(args[1:], ""))
+}
+
+// diagnostic is what the /bots/{id} checks answer with
+type diagnostic struct {
+	Time     int64     `json:"time"`
+	Bot      int       `json:"bot"`
+	Check    string    `json:"check"`
+	Request  string    `json:"request"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	Millis   int64     `json:"millis"`
+	Reply    string    `json:"reply,omitempty"`
+	Readings []float64 `json:"readings,omitempty"`
+	Mean     float64   `json:"mean,omitempty"`
+	Std      float64   `json:"std,omitempty"`
+	Mov      *struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Rot   float64 `json:"rot"`
+		Mov   string  `json:"mov"`
+	} `json:"mov,omitempty"`
+}
+
+// summary is one line about d
+func (d diagnostic) summary() string {
+	if !d.OK {
+		return fmt.Sprintf("bot %v: %v %v failed: %v", d.Bot, d.Check, d.Request, d.Error)
+	}
+	switch {
+	case d.Check == "ultrasonic":
+		return fmt.Sprintf("bot %v: %.1f cm (sd %.1f over %v readings: %v)", d.Bot, d.Mean, d.Std, len(d.Readings), d.Readings)
+	case d.Check == "move" && d.Mov != nil && d.Mov.Mov == "r":
+		return fmt.Sprintf("bot %v: move %v turned %.1f degrees", d.Bot, d.Request, d.Mov.Rot)
+	case d.Check == "calibrate":
+		return fmt.Sprintf("bot %v: calibrated, %v", d.Bot, d.Reply)
+	case d.Check == "onset":
+		return fmt.Sprintf("bot %v: %v", d.Bot, d.Reply)
+	case d.Check == "move" && d.Mov != nil:
+		return fmt.Sprintf("bot %v: move %v, wall %.1f -> %.1f cm", d.Bot, d.Request, d.Mov.Start, d.Mov.End)
+	}
+	return fmt.Sprintf("bot %v: %v %v ok (%v ms)", d.Bot, d.Check, d.Request, d.Millis)
+}
+
+// check runs a diagnostic on the server; a failed check still has a result
+// worth printing
+func check(id int, name, body string) error {
+	b, err := post(fmt.Sprintf("/bots/%d/%v", id, name), body)
+	if he, ok := err.(*httpError); ok && he.body != nil {
+		b = he.body
+	} else if err != nil {
+		return err
+	}
+	d := diagnostic{}
+	if json.Unmarshal(b, &d) != nil || d.Check == "" {
+		if err == nil {
+			err = fmt.Errorf("server answered %q", strings.TrimSpace(string(b)))
+		}
+		return err
+	}
+	if asJSON {
+		if perr := printJSON(d); perr != nil {
+			return perr
+		}
+	} else if d.OK {
+		fmt.Println(d.summary())
+	}
+	if !d.OK {
+		return fmt.Errorf("%v", d.Error)
+	}
+	return nil
+}
+
+func move(args []string) error {
+	if len(args) != 3 && !(len(args) == 2 && args[1] == "x") {
+		return fmt.Errorf("want <id> f|b|r|x <amount>")
+	}
+	id, err := botArg(args[0])
+	if err != nil {
+		return err
+	}
+	return check(id, "move", strings.Join(args[1:], ","))
+}
+
+func ultrasonic(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("want <id> [readings]")
+	}
+	id, err := botArg(args[0])
+	if err != nil {
+		return err
+	}
+	return check(id, "ultrasonic", strings.Join(args[1:], ""))
+}
+
+// checks lists the recorded diagnostics, of one bot or all of them
+func checks(args []string) error {
+	path := "/diagnostics"
+	switch len(args) {
+	case 0:
+	case 1:
+		id, err := botArg(args[0])
+		if err != nil {
+			return err
+		}
+		path = fmt.Sprintf("/bots/%d/diagnostics", id)
+	default:
+		return fmt.Errorf("takes at most one argument, the bot ID")
+	}
+	b, err := get(path)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	var ds []diagnostic
+	if err := json.Unmarshal(b, &ds); err != nil {
+		return err
+	}
+	if len(ds) == 0 {
+		fmt.Println("nothing checked yet")
+	}
+	for _, d := range ds {
+		fmt.Printf("%v  %v\n", time.Unix(0, d.Time*int64(time.Millisecond)).Format("15:04:05"), d.summary())
+	}
+	return nil
+}
+
+// calibration is what /calibration answers with, the parts printed
+type calibration struct {
+	ID       int     `json:"id"`
+	Fwd      float64 `json:"fwd"`
+	Bwd      float64 `json:"bwd"`
+	Rot      float64 `json:"rot"`
+	ListenMs float64 `json:"listenms"`
+	SpeakMs  float64 `json:"speakms"`
+	OnsetMs  float64 `json:"onsetms"`
+	Time     int64   `json:"time"`
+	Error    string  `json:"error"`
+}
+
+// intList reads "10,20,30"
+func intList(s string) ([]int, error) {
+	l := []int{}
+	if s == "" {
+		return l, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a whole number", v)
+		}
+		l = append(l, i)
+	}
+	return l, nil
+}
+
+func calibrate(args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+	show := fs.Bool("show", false, "print every bot's calibration instead")
+	moves := fs.String("moves", "", "cm to drive out and back, comma separated (the server's default when unset, none to skip)")
+	angles := fs.String("angles", "", "degrees to turn away from the wall and back, comma separated (none to skip)")
+	rounds := fs.Int("rounds", -1, "listens and speaks to time (0 to skip)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *show {
+		b, err := get("/calibration")
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			_, err := os.Stdout.Write(b)
+			return err
+		}
+		var cals []calibration
+		if err := json.Unmarshal(b, &cals); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tFWD\tBWD\tROT\tLISTEN MS\tSPEAK MS\tONSET MS\tFITTED")
+		for _, c := range cals {
+			fitted := "never"
+			if c.Time > 0 {
+				fitted = time.Unix(0, c.Time*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%v\t%.3f\t%.3f\t%.3f\t%.0f\t%.0f\t%.1f\t%v\n", c.ID, c.Fwd, c.Bwd, c.Rot, c.ListenMs, c.SpeakMs, c.OnsetMs, fitted)
+		}
+		return tw.Flush()
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want [flags] <id>, or -show")
+	}
+	id, err := botArg(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{}
+	for name, v := range map[string]string{"moves": *moves, "angles": *angles} {
+		switch v {
+		case "":
+		case "none":
+			req[name] = []int{}
+		default:
+			l, err := intList(v)
+			if err != nil {
+				return err
+			}
+			req[name] = l
+		}
+	}
+	if *rounds >= 0 {
+		req["rounds"] = *rounds
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// a calibration drives the bot around for a while
+	if client.Timeout < 10*time.Minute {
+		client.Timeout = 10 * time.Minute
+	}
+	b, err := post(fmt.Sprintf("/bots/%d/calibrate", id), string(body))
+	if he, ok := err.(*httpError); ok && he.status == http.StatusBadGateway {
+		b = he.body
+	} else if err != nil {
+		return err
+	}
+	c := calibration{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	if asJSON {
+		os.Stdout.Write(b)
+	} else {
+		fmt.Printf("bot %v: fwd %.3f, bwd %.3f, rot %.3f, listen %.0f ms, speak %.0f ms\n", id, c.Fwd, c.Bwd, c.Rot, c.ListenMs, c.SpeakMs)
+	}
+	if c.Error != "" {
+		return fmt.Errorf("%v", c.Error)
+	}
+	return nil
+}
+
+func onset(args []string) error {
+	fs := flag.NewFlagSet("onset", flag.ContinueOnError)
+	rounds := fs.Int("rounds", 0, "listen and speak rounds (the server's default when unset)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return fmt.Errorf("want [-rounds n] <id> <listener> <cm>")
+	}
+	id, err := botArg(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	listener, err := botArg(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	cm, err := strconv.ParseFloat(fs.Arg(2), 64)
+	if err != nil {
+		return fmt.Errorf("distance %q is not a number of cm", fs.Arg(2))
+	}
+	req := map[string]interface{}{"listener": listener, "distance": cm}
+	if *rounds > 0 {
+		req["rounds"] = *rounds
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// every round waits on both bots' samples
+	if client.Timeout < 5*time.Minute {
+		client.Timeout = 5 * time.Minute
+	}
+	b, err := post(fmt.Sprintf("/bots/%d/onset", id), string(body))
+	if he, ok := err.(*httpError); ok && he.status == http.StatusBadGateway {
+		b = he.body
+	} else if err != nil {
+		return err
+	}
+	c := calibration{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	if asJSON {
+		os.Stdout.Write(b)
+	} else if c.Error == "" {
+		fmt.Printf("bot %v: onset %.1f ms\n", id, c.OnsetMs)
+	}
+	if c.Error != "" {
+		return fmt.Errorf("%v", c.Error)
+	}
+	return nil
+}
+
+func exportMap(args []string) error {
+	fs := flag.NewFlagSet("export-map", flag.ContinueOnError)
+	out := fs.String("o", "", "`file` to write, map.png or map.json by default; - for stdout")
+	format := fs.String("format", "png", "png (the picture) or json (the dense grid)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := ""
+	switch *format {
+	case "png":
+		path = "/map.png"
+	case "json":
+		path = "/map?dense=1"
+	default:
+		return fmt.Errorf("unknown format %q, want png or json", *format)
+	}
+	if *out == "" {
+		*out = "map." + *format
+	}
+	b, err := get(path)
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(map[string]interface{}{"file": *out, "format": *format, "bytes": len(b)})
+	}
+	fmt.Printf("wrote %v (%v bytes)\n", *out, len(b))
+	return nil
+}
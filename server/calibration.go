@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *** CALIBRATION ***
+
+// POST /bots/{id}/calibrate runs a self-test of one bot, squarely facing a
+// wall 40-150 cm away with room to drive, and fits how far it really goes
+// per commanded cm and degree. doMovPost scales every command by the fit,
+// so "f,10" drives 10 cm whatever the motors think
+//  -- forward and backward: drive each of calMoves cm out and back, the
+//     ultrasonic readings before and after (in the /mov callback) are the
+//     truth
+//  -- rotation: turn each of calAngles degrees away from the wall and back;
+//     a flat wall d0 away reads d0 / cos(angle) once turned
+//  -- audio: calRounds listens and speaks, timing how long the bot takes
+//     from the command to recording or playing (ms, by its clock offset)
+// each fit is least squares through the origin, actual = scale * commanded,
+// and is refused outside calMinScale..calMaxScale
+
+// calibration json
+type calibration struct {
+	Fwd      float64     `json:"fwd"` // cm driven per cm commanded forward
+	Bwd      float64     `json:"bwd"` // cm driven per cm commanded backward
+	Rot      float64     `json:"rot"` // degrees turned per degree commanded
+	ListenMs float64     `json:"listenms,omitempty"`
+	SpeakMs  float64     `json:"speakms,omitempty"`
+	OnsetMs  float64     `json:"onsetms,omitempty"` // ms from the reported start of speaking to the tone, see onset.go
+	Time     int64       `json:"time,omitempty"`    // server millisecond timestamp of the last fit
+	Samples  []calSample `json:"samples,omitempty"` // what the last fit measured
+}
+
+// calibrate answer json
+type calibrateResult struct {
+	calibration
+	Error string `json:"error,omitempty"` // the part that failed, the rest was kept
+}
+
+// calibration list json
+type botCalibration struct {
+	ID int `json:"id"`
+	calibration
+}
+
+type calSample struct {
+	Kind   string  `json:"kind"` // f, b, r, listen, speak or onset (cmd the distance, actual the range)
+	Cmd    float64 `json:"cmd"`
+	Actual float64 `json:"actual"`
+}
+
+// calibration request json, every field optional; an empty list (or 0
+// rounds) skips that part
+type calibratePostData struct {
+	Moves  *[]int `json:"moves"`  // cm
+	Angles *[]int `json:"angles"` // degrees
+	Rounds *int   `json:"rounds"`
+}
+
+func (req calibratePostData) check() error {
+	if req.Moves != nil {
+		for _, d := range *req.Moves {
+			if d < 1 || d > diagMaxMove {
+				return fmt.Errorf("move %v cm is not between 1 and %v", d, diagMaxMove)
+			}
+		}
+	}
+	if req.Angles != nil {
+		for _, a := range *req.Angles {
+			if a < 1 || float64(a) > calMaxAngle {
+				return fmt.Errorf("angle %v is not between 1 and %v degrees", a, calMaxAngle)
+			}
+		}
+	}
+	if req.Rounds != nil && (*req.Rounds < 0 || *req.Rounds > calMaxRounds) {
+		return fmt.Errorf("rounds %v is not between 0 and %v", *req.Rounds, calMaxRounds)
+	}
+	return nil
+}
+
+var (
+	calMoves             = []int{10, 20, 30}
+	calAngles            = []int{10, 15, 20, 25}
+	calRounds    int     = 3
+	calMaxRounds int     = 20
+	calMinScale  float64 = 0.5
+	calMaxScale  float64 = 2
+	calMaxAngle  float64 = 45 // degrees, past this the echo is lost
+
+	calLock      sync.RWMutex // guards calibrations, read by doMovPost whoever holds stateLock
+	calibrations = make(map[int]calibration)
+)
+
+var defaultCalibration = calibration{Fwd: 1, Bwd: 1, Rot: 1}
+
+func calibrationOf(botID int) calibration {
+	calLock.RLock()
+	defer calLock.RUnlock()
+	if c, ok := calibrations[botID]; ok {
+		return c
+	}
+	return defaultCalibration
+}
+
+func setCalibration(botID int, c calibration) {
+	calLock.Lock()
+	calibrations[botID] = c
+	calLock.Unlock()
+}
+
+// calibrated is the command that makes botID actually move l
+func calibrated(c movCMD, l int, botID int) int {
+	cal := calibrationOf(botID)
+	scale := 1.0
+	switch c {
+	case movForward:
+		scale = cal.Fwd
+	case movBackward:
+		scale = cal.Bwd
+	case movRotate:
+		scale = cal.Rot
+	}
+	if scale <= 0 {
+		return l
+	}
+	return int(math.Round(float64(l) / scale))
+}
+
+// turned is how far botID really turned when it reports rot for a command
+// calibrated sent: the bot believes it turned what it was sent
+func turned(rot float64, botID int) float64 {
+	if s := calibrationOf(botID).Rot; s > 0 {
+		return rot * s
+	}
+	return rot
+}
+
+// fitScale fits actual = scale * cmd over the samples of kind
+func fitScale(samples []calSample, kind string) (float64, error) {
+	var ca, cc float64
+	n := 0
+	for _, s := range samples {
+		if s.Kind == kind {
+			ca += s.Cmd * s.Actual
+			cc += s.Cmd * s.Cmd
+			n++
+		}
+	}
+	if n < 2 || cc == 0 {
+		return 0, fmt.Errorf("%v: %v good measurements, need 2", kind, n)
+	}
+	scale := ca / cc
+	if scale < calMinScale || scale > calMaxScale {
+		return 0, fmt.Errorf("%v: scale %.2f is not between %v and %v, is it facing a wall?", kind, scale, calMinScale, calMaxScale)
+	}
+	return scale, nil
+}
+
+// calMove sends an uncalibrated command and waits for its callback
+func calMove(c movCMD, l int, botID int) (*movPostData, error) {
+	if isEstopped() {
+		return nil, errEstopped
+	}
+	ch, err := expectMov(botID)
+	if err != nil {
+		return nil, err
+	}
+	defer forgetMov(botID, ch)
+	reply, err := doRawMovPost(c, l, botID)
+	if err != nil {
+		return nil, err
+	}
+	if r := strings.TrimSpace(string(reply)); r == "busy" || r == "invalid command" {
+		return nil, fmt.Errorf("bot %v answered %q to %v,%d", botID, r, c, l)
+	}
+	return awaitMov(botID, ch, movTimeout)
+}
+
+// calRange is the mean of diagSamples ultrasonic readings
+func calRange(botID int) (float64, error) {
+	var sum float64
+	for i := 0; i < diagSamples; i++ {
+		z, err := doUltReadPost(1, botID)
+		if err != nil {
+			return 0, err
+		}
+		sum += z
+	}
+	return sum / float64(diagSamples), nil
+}
+
+// calibrateMoves drives out and back for every distance
+func calibrateMoves(botID int, moves []int, cal *calibration) error {
+	for _, d := range moves {
+		for _, c := range []movCMD{movForward, movBackward} {
+			mpd, err := calMove(c, d, botID)
+			if err != nil {
+				return err
+			}
+			actual := mpd.Start - mpd.End
+			if c == movBackward {
+				actual = -actual
+			}
+			if mpd.Start <= 0 || mpd.End <= 0 || actual <= 0 {
+				fmt.Printf("  bot %v: %v,%d read %.1f -> %.1f cm, skipped.\n", botID, c, d, mpd.Start, mpd.End)
+				continue
+			}
+			cal.Samples = append(cal.Samples, calSample{Kind: string(c), Cmd: float64(d), Actual: actual})
+		}
+	}
+	fwd, err := fitScale(cal.Samples, string(movForward))
+	if err != nil {
+		return err
+	}
+	bwd, err := fitScale(cal.Samples, string(movBackward))
+	if err != nil {
+		return err
+	}
+	cal.Fwd, cal.Bwd = fwd, bwd
+	return nil
+}
+
+// calibrateTurns turns away from the wall and back for every angle
+func calibrateTurns(botID int, angles []int, cal *calibration) error {
+	d0, err := calRange(botID)
+	if err != nil {
+		return err
+	}
+	for _, a := range angles {
+		if _, err := calMove(movRotate, a, botID); err != nil {
+			return err
+		}
+		d, err := calRange(botID)
+		if err != nil {
+			return err
+		}
+		if _, err := calMove(movRotate, -a, botID); err != nil {
+			return err
+		}
+		back, err := calRange(botID)
+		if err != nil {
+			return err
+		}
+		// squarest is shortest, whether or not the way back overshot
+		if back < d0 {
+			d0 = back
+		}
+		if d <= 0 || d0 <= 0 || d0/d < math.Cos(calMaxAngle*math.Pi/180) {
+			fmt.Printf("  bot %v: r,%d read %.1f -> %.1f cm, skipped.\n", botID, a, d0, d)
+			continue
+		}
+		actual := 0.0
+		if d > d0 {
+			actual = math.Acos(d0/d) * 180 / math.Pi
+		}
+		cal.Samples = append(cal.Samples, calSample{Kind: string(movRotate), Cmd: float64(a), Actual: actual})
+	}
+	rot, err := fitScale(cal.Samples, string(movRotate))
+	if err != nil {
+		return err
+	}
+	cal.Rot = rot
+	return nil
+}
+
+// calibrateAudio times rounds of listening and speaking alone
+func calibrateAudio(botID int, rounds int, cal *calibration) error {
+	acousticLock.Lock()
+	defer acousticLock.Unlock()
+	stateLock.RLock()
+	offset := clocks[botID]
+	stateLock.RUnlock()
+	var listen, speak float64
+	for i := 0; i < rounds; i++ {
+		for _, cmd := range []string{"l,100,0", "s,50,0"} {
+			drainLoc()
+			t0 := makeTimestamp()
+			if res := doLocPost(cmd, botID); res == nil || strings.TrimSpace(string(res)) == "busy" {
+				return fmt.Errorf("bot %v did not take %q", botID, cmd)
+			}
+			var lpd *locPostData
+			select {
+			case lpd = <-loc:
+			case <-time.After(locTimeout):
+				return fmt.Errorf("no /loc callback from bot %v after %v", botID, locTimeout)
+			}
+			ms := float64(lpd.Start + offset - t0)
+			kind := "listen"
+			if cmd[0] == 's' {
+				kind = "speak"
+				speak += ms / float64(rounds)
+			} else {
+				listen += ms / float64(rounds)
+			}
+			cal.Samples = append(cal.Samples, calSample{Kind: kind, Actual: ms})
+		}
+	}
+	cal.ListenMs, cal.SpeakMs = listen, speak
+	return nil
+}
+
+// calibrate runs the self-test of botID, keeping what it fits even when a
+// later part fails
+func calibrate(botID int, req calibratePostData) (calibration, error) {
+	cal := calibrationOf(botID)
+	cal.Samples = nil
+	moves, angles, rounds := calMoves, calAngles, calRounds
+	if req.Moves != nil {
+		moves = *req.Moves
+	}
+	if req.Angles != nil {
+		angles = *req.Angles
+	}
+	if req.Rounds != nil {
+		rounds = *req.Rounds
+	}
+	var err error
+	if len(moves) > 0 {
+		err = calibrateMoves(botID, moves, &cal)
+	}
+	if err == nil && len(angles) > 0 {
+		err = calibrateTurns(botID, angles, &cal)
+	}
+	if err == nil && rounds > 0 {
+		err = calibrateAudio(botID, rounds, &cal)
+	}
+	cal.Time = makeTimestamp()
+	setCalibration(botID, cal)
+	return cal, err
+}
+
+// handleCalibrate serves POST /bots/{id}/calibrate, which runs the
+// self-test, and POST /bots/{id}/calibration, which sets the scales by hand
+// (fields left out keep their value)
+func handleCalibrate(w http.ResponseWriter, r *http.Request, botID int, what string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "%v not allowed, only POST", r.Method)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	stateLock.RLock()
+	numBots := len(bot)
+	stateLock.RUnlock()
+	if botID < 0 || botID >= numBots {
+		writeError(w, http.StatusNotFound, "no bot %v (%v registered)", botID, numBots)
+		return
+	}
+	if what == "calibration" {
+		cal := calibrationOf(botID)
+		if err := json.Unmarshal(body, &cal); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		for _, s := range []float64{cal.Fwd, cal.Bwd, cal.Rot} {
+			if s < calMinScale || s > calMaxScale {
+				writeError(w, http.StatusBadRequest, "scale %v is not between %v and %v", s, calMinScale, calMaxScale)
+				return
+			}
+		}
+		if math.Abs(cal.OnsetMs) > onsetMax {
+			writeError(w, http.StatusBadRequest, "onset %v is not between -%v and %v ms", cal.OnsetMs, onsetMax, onsetMax)
+			return
+		}
+		setCalibration(botID, cal)
+		writeJSON(w, http.StatusOK, cal)
+		return
+	}
+	req := calibratePostData{}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	if err := req.check(); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	diagLock.Lock()
+	defer diagLock.Unlock()
+	if _, err := runByID(0); err == nil {
+		writeError(w, http.StatusConflict, "an exploration is running, stop it first")
+		return
+	}
+	if isEstopped() {
+		writeError(w, http.StatusConflict, "%v", errEstopped)
+		return
+	}
+	fmt.Printf("  bot %v: calibrating.\n", botID)
+	d := diagnostic{Time: makeTimestamp(), Bot: botID, Check: "calibrate", Request: strings.TrimSpace(string(body))}
+	start := time.Now()
+	cal, err := calibrate(botID, req)
+	d.Millis = time.Since(start).Milliseconds()
+	d.OK = err == nil
+	d.Reply = fmt.Sprintf("fwd %.3f, bwd %.3f, rot %.3f, listen %.0f ms, speak %.0f ms", cal.Fwd, cal.Bwd, cal.Rot, cal.ListenMs, cal.SpeakMs)
+	status := http.StatusOK
+	if err != nil {
+		d.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	recordDiagnostic(d)
+	writeJSON(w, status, calibrateResult{calibration: cal, Error: d.Error})
+}
+
+// handleCalibrations serves GET /calibration, every bot's
+func handleCalibrations(w http.ResponseWriter, r *http.Request) {
+	if onlyGET(w, r) {
+		return
+	}
+	stateLock.RLock()
+	numBots := len(bot)
+	stateLock.RUnlock()
+	cals := []botCalibration{}
+	for id := 0; id < numBots; id++ {
+		cals = append(cals, botCalibration{ID: id, calibration: calibrationOf(id)})
+	}
+	writeJSON(w, http.StatusOK, cals)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitScale(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []calSample
+		kind    string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name:    "exact",
+			samples: []calSample{{"f", 10, 11}, {"f", 20, 22}, {"f", 30, 33}},
+			kind:    "f",
+			want:    1.1,
+		},
+		{
+			name:    "least squares",
+			samples: []calSample{{"r", 90, 80}, {"r", 90, 82}},
+			kind:    "r",
+			want:    0.9,
+		},
+		{
+			name:    "other kinds ignored",
+			samples: []calSample{{"f", 10, 30}, {"b", 10, 9}, {"b", 20, 18}, {"r", 90, 45}},
+			kind:    "b",
+			want:    0.9,
+		},
+		{
+			name:    "one measurement",
+			samples: []calSample{{"f", 10, 11}, {"b", 10, 9}},
+			kind:    "f",
+			wantErr: true,
+		},
+		{
+			name:    "no commands",
+			samples: []calSample{{"f", 0, 1}, {"f", 0, 2}},
+			kind:    "f",
+			wantErr: true,
+		},
+		{
+			name:    "facing a wall",
+			samples: []calSample{{"f", 10, 1}, {"f", 20, 2}},
+			kind:    "f",
+			wantErr: true,
+		},
+		{
+			name:    "too far",
+			samples: []calSample{{"f", 10, 50}, {"f", 20, 100}},
+			kind:    "f",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fitScale(tt.samples, tt.kind)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("fitScale = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fitScale: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("fitScale = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// *** MULTI-ROBOT TASK ALLOCATION ***
+
+// auction: frontier goals handed out across the fleet so no two bots
+// explore the same area
+//  -- botjobs[id] is true while bot id holds a goal
+//  -- botids[goal] is the bot holding that goal
+//  -- a bot asking for a goal releases the one it holds; if it is not
+//     there yet (planning failed) it will not be handed that goal again
+//  -- goals are auctioned to the idle bots greedily by score, the asking
+//     bot takes whatever it wins; only bots the run started with bid, and
+//     not once they have failed
+
+var arriveRadius float64 = 1.5 // cells from its goal a bot counts as arrived
+
+type auctionPolicy struct {
+	frontier    *frontierPolicy
+	claimRadius float64               // cells around a held goal nobody else may take
+	goals       map[int]cell          // [botID] -> goal it holds
+	failed      map[int]map[cell]bool // [botID] -> goals it could not reach
+}
+
+func newAuctionPolicy(params policyParams) (Policy, error) {
+	fp, err := newFrontierPolicy(params)
+	if err != nil {
+		return nil, err
+	}
+	ap := &auctionPolicy{
+		frontier:    fp.(*frontierPolicy),
+		claimRadius: params.get("claimradius", 5),
+		goals:       make(map[int]cell),
+		failed:      make(map[int]map[cell]bool),
+	}
+	if ap.claimRadius < 0 {
+		return nil, fmt.Errorf("auction: claimradius must be >= 0")
+	}
+	return ap, nil
+}
+
+func (ap *auctionPolicy) OnMeasurement(botID int, from, hit cell) {}
+
+func (ap *auctionPolicy) OnPlanFailed(botID int, goal cell) {
+	if ap.failed[botID] == nil {
+		ap.failed[botID] = make(map[cell]bool)
+	}
+	ap.failed[botID][goal] = true
+	ap.releaseGoal(botID)
+}
+
+// releaseGoal frees the goal botID holds, if any
+func (ap *auctionPolicy) releaseGoal(botID int) (cell, bool) {
+	goal, ok := ap.goals[botID]
+	if !ok {
+		return cell{}, false
+	}
+	delete(ap.goals, botID)
+	delete(botids, goal)
+	botjobs[botID] = false
+	return goal, true
+}
+
+func (ap *auctionPolicy) claimGoal(botID int, goal cell) {
+	ap.goals[botID] = goal
+	botids[goal] = botID
+	botjobs[botID] = true
+}
+
+// claimed reports whether c is too close to a goal another bot holds
+func (ap *auctionPolicy) claimed(c cell, botID int) bool {
+	for goal, holder := range botids {
+		if holder != botID && euclDist(float64(c.x), float64(c.y), float64(goal.x), float64(goal.y)) <= ap.claimRadius {
+			return true
+		}
+	}
+	return false
+}
+
+type bid struct {
+	botID  int
+	target cell
+	score  float64
+}
+
+func (ap *auctionPolicy) NextGoal(botID int, from cell) (cell, bool) {
+	old, ok := ap.releaseGoal(botID)
+	if ok && euclDist(float64(old.x), float64(old.y), float64(from.x), float64(from.y)) > arriveRadius {
+		// asked again before arriving, so old was unreachable
+		if ap.failed[botID] == nil {
+			ap.failed[botID] = make(map[cell]bool)
+		}
+		ap.failed[botID][old] = true
+		fmt.Printf(" bot %v: released unreachable goal %v\n", botID, old)
+	}
+	// unclaimed frontier targets
+	targets := []cell{}
+	for _, cluster := range clusterFrontiers(frontierCells(), ap.frontier.minSize, ap.frontier.maxSize) {
+		t := clusterTarget(cluster)
+		if !ap.claimed(t, botID) {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		fmt.Printf(" bot %v: no unclaimed frontier, picking a random goal.\n", botID)
+		return randomGoal(from, 10, 2), true
+	}
+	// every idle bot of this run bids on every target
+	lo, hi, _ := knownBounds()
+	bids := []bid{}
+	for id := range bot {
+		if !runBots[id] || botjobs[id] || id >= len(pos) || botStates[id] == stateFailed {
+			continue
+		}
+		start := binPose(pos[id])
+		if id == botID {
+			start = from
+		}
+		blo, bhi := boundsWith(lo, hi, start)
+		cost := pathCosts(start, blo, bhi, planBlocked(id))
+		for _, t := range targets {
+			c, reachable := cost[t]
+			if !reachable || c == 0 || ap.failed[id][t] {
+				continue
+			}
+			score := float64(informationGain(t, ap.frontier.infoRadius)) - ap.frontier.lambda*float64(c)
+			bids = append(bids, bid{botID: id, target: t, score: score})
+		}
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i].score > bids[j].score })
+	// greedy auction, best bid first; a target won by one bot takes its
+	// neighborhood off the table for the others
+	won := map[int]cell{}
+	for _, b := range bids {
+		if _, ok := won[b.botID]; ok {
+			continue
+		}
+		taken := false
+		for _, t := range won {
+			if euclDist(float64(t.x), float64(t.y), float64(b.target.x), float64(b.target.y)) <= ap.claimRadius {
+				taken = true
+				break
+			}
+		}
+		if taken {
+			continue
+		}
+		won[b.botID] = b.target
+		if b.botID == botID {
+			break
+		}
+	}
+	goal, ok := won[botID]
+	if !ok {
+		fmt.Printf(" bot %v: outbid on every frontier, picking a random goal.\n", botID)
+		return randomGoal(from, 10, 2), true
+	}
+	ap.claimGoal(botID, goal)
+	fmt.Printf(" bot %v: won frontier goal %v\n", botID, goal)
+	return goal, true
+}
+
+// releaseBot gives up whatever goal botID holds, eg when it stops answering
+// (caller must hold stateLock)
+func releaseBot(botID int) {
+	if ap, ok := activePolicy.(*auctionPolicy); ok {
+		ap.releaseGoal(botID)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+// corridor is a walled corridor of free cells, x 0 to 20 and y -3 to 3,
+// open at both ends, so its frontiers are the two ends
+func corridor(m map[cell]float64) {
+	knownFree(m, cell{0, -3}, cell{20, 3})
+	for x := -1; x <= 21; x++ {
+		m[cell{x: x, y: -4}] = 2 * occThresh
+		m[cell{x: x, y: 4}] = 2 * occThresh
+	}
+}
+
+func TestAuction(t *testing.T) {
+	defer func(m map[cell]float64, p []pose, b []string, bs []botState, rr float64, bj map[int]bool, bi map[cell]int, rb map[int]bool) {
+		ogm, pos, bot, botStates, robotRadius, botjobs, botids, runBots = m, p, b, bs, rr, bj, bi, rb
+	}(ogm, pos, bot, botStates, robotRadius, botjobs, botids, runBots)
+	robotRadius = 0
+
+	left, right := cell{0, 0}, cell{20, 0}
+	tests := []struct {
+		name     string
+		poses    []pose       // bot 0 asks
+		held     map[int]cell // goals other bots hold
+		failed   []cell       // goals bot 0 could not reach
+		failBots []int        // bots that stopped answering
+		want     cell
+	}{
+		{name: "nearest end", poses: []pose{{25, 5, 0}}, want: left},
+		{name: "nearest end, other side", poses: []pose{{175, 5, 0}}, want: right},
+		{name: "outbid on the near end", poses: []pose{{45, -25, 0}, {15, 35, 0}}, want: right},
+		{name: "near end held", poses: []pose{{25, 5, 0}, {175, 5, 0}}, held: map[int]cell{1: left}, want: right},
+		{name: "failed bots do not bid", poses: []pose{{45, -25, 0}, {15, 35, 0}}, failBots: []int{1}, want: left},
+		{name: "unreachable end skipped", poses: []pose{{25, 5, 0}}, failed: []cell{left}, want: right},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			corridor(ogm)
+			pos, bot = tt.poses, make([]string, len(tt.poses))
+			botStates = make([]botState, len(tt.poses))
+			runBots = make(map[int]bool)
+			for id := range bot {
+				runBots[id] = true
+			}
+			for _, id := range tt.failBots {
+				botStates[id] = stateFailed
+			}
+			botjobs, botids = make(map[int]bool), make(map[cell]int)
+			p, err := newAuctionPolicy(policyParams{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ap := p.(*auctionPolicy)
+			for id, g := range tt.held {
+				ap.claimGoal(id, g)
+			}
+			for _, g := range tt.failed {
+				ap.OnPlanFailed(0, g)
+			}
+			got, ok := ap.NextGoal(0, binPose(pos[0]))
+			if !ok || got != tt.want {
+				t.Fatalf("NextGoal = %v, %v; want %v", got, ok, tt.want)
+			}
+			if !botjobs[0] || botids[got] != 0 {
+				t.Fatalf("NextGoal won %v but bot 0 does not hold it: %v %v", got, botjobs, botids)
+			}
+			for id, g := range tt.held {
+				if botids[g] != id {
+					t.Fatalf("NextGoal took %v from bot %v: %v", g, id, botids)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// *** DASHBOARD ***
+
+// GET / is a page showing the map, every bot and the exploration, kept up
+// to date by the server-sent events of GET /dashboard/state; its buttons
+// just call the endpoints below
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+var dashboardEvery time.Duration = 500 * time.Millisecond // how often the state is pushed
+
+// dashboard bot json
+type dashBot struct {
+	ID      int     `json:"id"`
+	IP      string  `json:"ip"`
+	State   string  `json:"state"`
+	Pose    pose    `json:"pose"`
+	SigmaXY float64 `json:"sigmaxy"` // cm
+	Lost    bool    `json:"lost"`
+	Path    []cell  `json:"path"`
+}
+
+// dashboard state json
+type dashState struct {
+	Time      int64      `json:"time"` // server millisecond timestamp
+	Localized bool       `json:"localized"`
+	Localize  int        `json:"localize"` // most bots POST /localize takes
+	Estop     bool       `json:"estop"`
+	Estimator string     `json:"estimator"`
+	Policies  []string   `json:"policies"`
+	Cells     int        `json:"cells"` // known cells on the map
+	Run       *runStatus `json:"run"`   // null when not exploring
+	Bots      []dashBot  `json:"bots"`
+}
+
+func dashboardState() *dashState {
+	ds := &dashState{
+		Time:      makeTimestamp(),
+		Estop:     isEstopped(),
+		Estimator: defaultEstimator,
+		Policies:  []string{},
+		Bots:      []dashBot{},
+	}
+	for name := range policies {
+		ds.Policies = append(ds.Policies, name)
+	}
+	sort.Strings(ds.Policies)
+	if run, err := runByID(0); err == nil {
+		ds.Run = run.status()
+	}
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	ds.Localized = localized
+	ds.Localize = localizeLimit()
+	for c := range ogm {
+		if !isUnknown(c) {
+			ds.Cells++
+		}
+	}
+	for id, ip := range bot {
+		db := dashBot{ID: id, IP: ip, Path: []cell{}}
+		if id < len(botStates) {
+			db.State = botStates[id].String()
+		}
+		if id < len(pos) {
+			db.Pose = pos[id]
+			db.SigmaXY = positionSigma(id)
+			db.Lost = lost[id]
+		}
+		if id < len(paths) {
+			db.Path = append(db.Path, paths[id]...)
+		}
+		ds.Bots = append(ds.Bots, db)
+	}
+	return ds
+}
+
+// streamDashboard pushes the dashboard state as server-sent events until
+// the client goes away
+func streamDashboard(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming unsupported!\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(dashboardEvery)
+	defer ticker.Stop()
+	for {
+		b, err := json.Marshal(dashboardState())
+		if err != nil {
+			fmt.Printf(" streamDashboard error -- %v\n", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", b); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *** DIAGNOSTICS ***
+
+// bring-up checks run through the server against a registered bot, instead
+// of curling the bots one by one (robot/test/test.sh):
+//   POST /bots/{id}/beep        body: Hz, the ranging tone when empty
+//   POST /bots/{id}/ultrasonic  body: how many readings, diagSamples when empty
+//   POST /bots/{id}/move        body: "f,10" or "b,10" (cm), "r,90" (degrees), "x"
+// every check answers with its result, which is also kept (and snapshotted)
+// for GET /bots/{id}/diagnostics and GET /diagnostics, and published as a
+// "diagnostic" event
+//  -- a move waits for the bot's /mov callback, and is refused while
+//     exploring (the run moves the bots) or emergency stopped
+//  -- moves are jogs: the bot's pose is not updated
+
+// diagnostic json
+type diagnostic struct {
+	Time     int64        `json:"time"` // server millisecond timestamp
+	Bot      int          `json:"bot"`
+	Check    string       `json:"check"`   // beep, ultrasonic or move
+	Request  string       `json:"request"` // the check as asked for, before calibration
+	OK       bool         `json:"ok"`
+	Error    string       `json:"error,omitempty"`
+	Millis   int64        `json:"millis"`             // how long the check took
+	Reply    string       `json:"reply,omitempty"`    // what the bot answered
+	Readings []float64    `json:"readings,omitempty"` // ultrasonic cm
+	Mean     float64      `json:"mean,omitempty"`
+	Std      float64      `json:"std,omitempty"`
+	Mov      *movPostData `json:"mov,omitempty"` // the bot's callback after a move
+}
+
+var (
+	diagSamples int        = 5
+	diagMaxRead int        = 50  // readings per check
+	diagMaxMove int        = 200 // cm
+	diagMaxTurn int        = 360 // degrees
+	diagKeep    int        = 200 // results kept per bot
+	diagLock    sync.Mutex       // one check talks to the bots at a time
+
+	diagnostics = make(map[int][]diagnostic) // [botID] -> results, oldest first
+)
+
+// diagChecks run a check against botID with the request body, filling in d
+var diagChecks = map[string]func(botID int, body string, d *diagnostic) (int, error){
+	"beep":       diagBeep,
+	"ultrasonic": diagUltrasonic,
+	"move":       diagMove,
+}
+
+// handleDiagnostic runs check against botID and answers with the result
+func handleDiagnostic(w http.ResponseWriter, r *http.Request, botID int, check string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "%v not allowed, only POST", r.Method)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	stateLock.RLock()
+	numBots := len(bot)
+	stateLock.RUnlock()
+	if botID < 0 || botID >= numBots {
+		writeError(w, http.StatusNotFound, "no bot %v (%v registered)", botID, numBots)
+		return
+	}
+	diagLock.Lock()
+	defer diagLock.Unlock()
+	d := diagnostic{Time: makeTimestamp(), Bot: botID, Check: check, Request: strings.TrimSpace(string(body))}
+	start := time.Now()
+	status, err := diagChecks[check](botID, d.Request, &d)
+	if status == http.StatusBadRequest || status == http.StatusConflict {
+		// nothing was checked
+		writeError(w, status, "%v", err)
+		return
+	}
+	d.Millis = time.Since(start).Milliseconds()
+	d.OK = err == nil
+	if err != nil {
+		d.Error = err.Error()
+	}
+	recordDiagnostic(d)
+	writeJSON(w, status, d)
+}
+
+// recordDiagnostic keeps d and publishes it
+func recordDiagnostic(d diagnostic) {
+	stateLock.Lock()
+	ds := append(diagnostics[d.Bot], d)
+	if len(ds) > diagKeep {
+		ds = ds[len(ds)-diagKeep:]
+	}
+	diagnostics[d.Bot] = ds
+	stateLock.Unlock()
+	if d.OK {
+		fmt.Printf("  bot %v: %v %q ok.\n", d.Bot, d.Check, d.Request)
+	} else {
+		fmt.Printf("  bot %v: %v %q failed -- %v\n", d.Bot, d.Check, d.Request, d.Error)
+	}
+	publish(evDiagnostic, d.Bot, d)
+}
+
+// diagnosticsOf returns botID's results, or everyone's by time for -1
+// (caller must hold stateLock)
+func diagnosticsOf(botID int) []diagnostic {
+	ds := []diagnostic{}
+	if botID >= 0 {
+		return append(ds, diagnostics[botID]...)
+	}
+	for _, bds := range diagnostics {
+		ds = append(ds, bds...)
+	}
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].Time < ds[j].Time })
+	return ds
+}
+
+func handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if onlyGET(w, r) {
+		return
+	}
+	stateLock.RLock()
+	ds := diagnosticsOf(-1)
+	stateLock.RUnlock()
+	writeJSON(w, http.StatusOK, ds)
+}
+
+func diagBeep(botID int, body string, d *diagnostic) (int, error) {
+	hz := tone
+	if body != "" {
+		var err error
+		if hz, err = strconv.Atoi(body); err != nil || hz <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("frequency %q is not a number of Hz", body)
+		}
+	}
+	d.Request = strconv.Itoa(hz)
+	if err := doBepPost(hz, botID); err != nil {
+		return http.StatusBadGateway, err
+	}
+	return http.StatusOK, nil
+}
+
+// diagUltrasonic takes single-echo readings one at a time, so their spread
+// shows how noisy the sensor is
+func diagUltrasonic(botID int, body string, d *diagnostic) (int, error) {
+	n := diagSamples
+	if body != "" {
+		var err error
+		if n, err = strconv.Atoi(body); err != nil || n < 1 || n > diagMaxRead {
+			return http.StatusBadRequest, fmt.Errorf("readings %q is not between 1 and %v", body, diagMaxRead)
+		}
+	}
+	d.Request = strconv.Itoa(n)
+	d.Readings = []float64{}
+	for i := 0; i < n; i++ {
+		z, err := doUltReadPost(1, botID)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		d.Readings = append(d.Readings, z)
+	}
+	for _, z := range d.Readings {
+		d.Mean += z / float64(n)
+	}
+	for _, z := range d.Readings {
+		d.Std += (z - d.Mean) * (z - d.Mean) / float64(n)
+	}
+	d.Std = math.Sqrt(d.Std)
+	return http.StatusOK, nil
+}
+
+// parseJog reads "f,10", "b,10", "r,-90" or "x"
+func parseJog(body string) (movCMD, int, error) {
+	s := strings.Split(body, ",")
+	c := movCMD(strings.TrimSpace(s[0]))
+	if c == movStop && len(s) == 1 {
+		return c, 0, nil
+	}
+	if len(s) != 2 {
+		return "", 0, fmt.Errorf("move %q is not f,cm b,cm r,degrees or x", body)
+	}
+	l, err := strconv.Atoi(strings.TrimSpace(s[1]))
+	if err != nil {
+		return "", 0, fmt.Errorf("move %q is not f,cm b,cm r,degrees or x", body)
+	}
+	switch c {
+	case movForward, movBackward:
+		if l < 0 || l > diagMaxMove {
+			return "", 0, fmt.Errorf("%v cm is not between 0 and %v", l, diagMaxMove)
+		}
+	case movRotate:
+		if l < -diagMaxTurn || l > diagMaxTurn {
+			return "", 0, fmt.Errorf("%v degrees is not between -%v and %v", l, diagMaxTurn, diagMaxTurn)
+		}
+	case movStop:
+	default:
+		return "", 0, fmt.Errorf("move %q is not f,cm b,cm r,degrees or x", body)
+	}
+	return c, l, nil
+}
+
+func diagMove(botID int, body string, d *diagnostic) (int, error) {
+	c, l, err := parseJog(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	d.Request = fmt.Sprintf("%v,%d", c, l)
+	var ch chan *movPostData
+	if c != movStop {
+		if _, err := runByID(0); err == nil {
+			return http.StatusConflict, fmt.Errorf("an exploration is running, stop it first")
+		}
+		if isEstopped() {
+			return http.StatusConflict, errEstopped
+		}
+		// this move's callback is ours, not the run's
+		if ch, err = expectMov(botID); err != nil {
+			return http.StatusConflict, err
+		}
+		defer forgetMov(botID, ch)
+	}
+	reply, err := doMovPost(c, l, botID)
+	d.Reply = strings.TrimSpace(string(reply))
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	switch d.Reply {
+	case "busy":
+		return http.StatusServiceUnavailable, fmt.Errorf("bot %v is busy", botID)
+	case "invalid command":
+		return http.StatusBadGateway, fmt.Errorf("bot %v did not understand %q", botID, d.Request)
+	}
+	if c == movStop {
+		return http.StatusOK, nil
+	}
+	mpd, err := awaitMov(botID, ch, movTimeout)
+	if err != nil {
+		return http.StatusGatewayTimeout, err
+	}
+	d.Mov = mpd
+	return http.StatusOK, nil
+}
+
+// *** MOV WAITERS ***
+
+// a check, a calibration or localize that moves a bot takes that bot's next
+// /mov callback for itself; every other callback still goes down mov to the
+// run, so neither steals the other's
+
+var (
+	movWaitLock sync.Mutex
+	movWaiters  = make(map[int]chan *movPostData) // [botID] -> who takes its next /mov callback
+)
+
+// expectMov claims botID's next /mov callback; call it before sending the
+// command, so a quick callback is not missed
+func expectMov(botID int) (chan *movPostData, error) {
+	movWaitLock.Lock()
+	defer movWaitLock.Unlock()
+	if _, ok := movWaiters[botID]; ok {
+		return nil, fmt.Errorf("bot %v is already being waited on", botID)
+	}
+	ch := make(chan *movPostData, 1)
+	movWaiters[botID] = ch
+	return ch, nil
+}
+
+// forgetMov gives up botID's claim from expectMov, if it still stands
+func forgetMov(botID int, ch chan *movPostData) {
+	movWaitLock.Lock()
+	defer movWaitLock.Unlock()
+	if movWaiters[botID] == ch {
+		delete(movWaiters, botID)
+	}
+}
+
+// awaitMov waits for the callback claimed by expectMov
+func awaitMov(botID int, ch chan *movPostData, timeout time.Duration) (*movPostData, error) {
+	select {
+	case mpd := <-ch:
+		return mpd, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no /mov callback from bot %v after %v", botID, timeout)
+	}
+}
+
+// deliverMov hands a /mov callback to whoever claimed it, or to the run
+func deliverMov(mpd *movPostData) {
+	movWaitLock.Lock()
+	ch, ok := movWaiters[mpd.ID]
+	delete(movWaiters, mpd.ID)
+	movWaitLock.Unlock()
+	if ok {
+		ch <- mpd
+		return
+	}
+	mov <- mpd
+}
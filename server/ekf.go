@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// *** EXTENDED KALMAN FILTER ***
+
+// one gaussian per bot, pos[] is its mean and poseCovs[] its covariance:
+// applyMotion is the prediction, and each ultrasonic reading and acoustic
+// range is folded in through its linearized measurement model
+//  -- a reading is expected to hit the first wall on the map along the
+//     bot's heading; readings with no such wall (or past ultMax) carry no
+//     information about the pose and are skipped
+//  -- readings more than rangeGate sigmas off what the map predicts are
+//     taken for junk (or an unmapped obstacle) and dropped
+//  -- relocalizing asks for an acoustic range, there is no global search
+
+var ekfDr float64 = 2 // degrees either side when linearizing the reading in the heading
+
+type ekfEstimator struct{}
+
+func (ekfEstimator) Predict(botID int, rot, d float64) {
+	applyMotion(botID, rot, d)
+}
+
+func (ekfEstimator) Measure(botID int, z float64) {
+	if err := ekfMeasure(botID, z); err != nil {
+		fmt.Printf("  bot %v: %v\n", botID, err)
+	}
+}
+
+func (ekfEstimator) Range(botID int, other pose, otherP covariance, z float64) error {
+	rf, err := fitRange(botID, other, otherP, z)
+	if err != nil {
+		return err
+	}
+	ekfCorrect(botID, rf.Pu, rf.S, rf.nu)
+	return nil
+}
+
+func (ekfEstimator) Relocalize(botID int) error {
+	if len(pos) < 2 {
+		return fmt.Errorf("no other bot to range bot %v against", botID)
+	}
+	rangeWanted[botID] = true
+	return nil
+}
+
+// wallAhead is the distance from p to the first wall on the map along its
+// heading, false when there is none within ultMax
+func wallAhead(p pose) (float64, bool) {
+	th := p.r * math.Pi / 180
+	step := math.Min(xscale, yscale) / 2
+	for t := 0.0; t < ultMax; t += step {
+		c := binPose(pose{x: p.x + t*math.Cos(th), y: p.y + t*math.Sin(th)})
+		if ogm[c] >= occThresh {
+			return t, true
+		}
+	}
+	return ultMax, false
+}
+
+// ekfMeasure corrects botID by ultrasonic reading z (caller must hold
+// stateLock)
+func ekfMeasure(botID int, z float64) error {
+	p := pos[botID]
+	h, ok := wallAhead(p)
+	if !ok || z >= ultMax {
+		return nil
+	}
+	// the map is cells, so linearize by central differences half a cell
+	// (or ekfDr degrees) either side
+	steps := [3]float64{xscale / 2, yscale / 2, ekfDr}
+	H := [3]float64{}
+	for i := range H {
+		lo, hi := p, p
+		switch i {
+		case 0:
+			lo.x -= steps[i]
+			hi.x += steps[i]
+		case 1:
+			lo.y -= steps[i]
+			hi.y += steps[i]
+		case 2:
+			lo.r = normalizeDeg(lo.r - steps[i])
+			hi.r = normalizeDeg(hi.r + steps[i])
+		}
+		hl, okl := wallAhead(lo)
+		hh, okh := wallAhead(hi)
+		if !okl || !okh {
+			// at the edge of what the map knows
+			return nil
+		}
+		H[i] = (hh - hl) / (2 * steps[i])
+	}
+	P := poseCovs[botID]
+	PH := [3]float64{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			PH[i] += P[i][j] * H[j]
+		}
+	}
+	S := H[0]*PH[0] + H[1]*PH[1] + H[2]*PH[2] + ultSigma*ultSigma
+	nu := z - h
+	if nu*nu > rangeGate*rangeGate*S {
+		return fmt.Errorf("reading %.1f cm is %.1f sigmas off the %.1f cm the map expects, ignoring", z, math.Abs(nu)/math.Sqrt(S), h)
+	}
+	ekfCorrect(botID, PH, S, nu)
+	return nil
+}
+
+// ekfCorrect applies a scalar measurement to botID: PH is the covariance
+// times the measurement jacobian, S the innovation variance and nu the
+// innovation (caller must hold stateLock)
+func ekfCorrect(botID int, PH [3]float64, S, nu float64) {
+	p := pos[botID]
+	P := poseCovs[botID]
+	K := [3]float64{PH[0] / S, PH[1] / S, PH[2] / S}
+	p.x += K[0] * nu
+	p.y += K[1] * nu
+	p.r = normalizeDeg(p.r + K[2]*nu)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			P[i][j] -= K[i] * PH[j]
+		}
+	}
+	pos[botID] = p
+	poseCovs[botID] = P
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// *** POSE ESTIMATORS ***
+
+// Estimator keeps pos[] and poseCovs[] up to date from everything the bots
+// report; policy(), the planner and the ogm update all go by what it says.
+// Every method is called with stateLock held.
+type Estimator interface {
+	// Predict moves botID by a /mov callback: turned rot degrees, then
+	// drove d cm
+	Predict(botID int, rot, d float64)
+	// Measure corrects botID by ultrasonic reading z against the ogm,
+	// before the reading goes into it
+	Measure(botID int, z float64)
+	// Range corrects botID by acoustic range z to a bot at other (with
+	// covariance otherP)
+	Range(botID int, other pose, otherP covariance, z float64) error
+	// Relocalize starts finding botID again when its pose is not to be
+	// trusted anymore
+	Relocalize(botID int) error
+}
+
+// estimators are every Estimator -estimator can pick, by name
+var estimators = map[string]Estimator{
+	"odometry": odometryEstimator{},
+	"mcl":      mclEstimator{},
+	"ekf":      ekfEstimator{},
+}
+
+var (
+	defaultEstimator string    = "ekf"
+	activeEstimator  Estimator = ekfEstimator{}
+)
+
+func estimatorNames() string {
+	names := make([]string, 0, len(estimators))
+	for name := range estimators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// odometry: dead reckoning only, nothing corrects it
+
+type odometryEstimator struct{}
+
+func (odometryEstimator) Predict(botID int, rot, d float64) {
+	applyMotion(botID, rot, d)
+}
+
+func (odometryEstimator) Measure(botID int, z float64) {}
+
+func (odometryEstimator) Range(botID int, other pose, otherP covariance, z float64) error {
+	return nil
+}
+
+func (odometryEstimator) Relocalize(botID int) error {
+	return fmt.Errorf("the odometry estimator cannot relocalize")
+}
+
+// mcl: the particle filter, see mcl.go
+
+type mclEstimator struct{}
+
+func (mclEstimator) Predict(botID int, rot, d float64) {
+	applyMotion(botID, rot, d)
+	mclPredict(botID, rot, d)
+}
+
+func (mclEstimator) Measure(botID int, z float64) {
+	mclUpdate(botID, z)
+}
+
+func (mclEstimator) Range(botID int, other pose, otherP covariance, z float64) error {
+	return mclRange(botID, other, otherP, z)
+}
+
+func (mclEstimator) Relocalize(botID int) error {
+	return mclRelocalize(botID)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// *** EMERGENCY STOP ***
+
+// once engaged, every bot is told to stop and no motion command leaves the
+// server until the stop is cleared; stop commands themselves always go out
+
+var (
+	estopLock   sync.RWMutex // guards estopped
+	estopped    bool
+	errEstopped = errors.New("emergency stop is engaged")
+)
+
+func isEstopped() bool {
+	estopLock.RLock()
+	defer estopLock.RUnlock()
+	return estopped
+}
+
+// emergencyStop halts the fleet: motion is refused from here on, every bot
+// gets a stop right away, and the exploration (if any) is cancelled
+func emergencyStop() {
+	estopLock.Lock()
+	estopped = true
+	estopLock.Unlock()
+	fmt.Println("EMERGENCY STOP.")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		// don't wait on the exploration to wind down before stopping the bots
+		defer wg.Done()
+		haltAll()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := stopExploration(0); err != nil {
+			// no run, still drop whatever commands were pending
+			stateLock.Lock()
+			for id := range botStates {
+				stopMovTimer(id)
+				paths[id] = nil
+				releaseReservations(id)
+				setState(id, stateIdle, "emergency stop")
+			}
+			stateLock.Unlock()
+		}
+	}()
+	wg.Wait()
+}
+
+// clearEstop lets motion commands through again
+func clearEstop() {
+	estopLock.Lock()
+	estopped = false
+	estopLock.Unlock()
+	fmt.Println("emergency stop cleared.")
+}
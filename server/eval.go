@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// *** EVALUATION ***
+
+// -eval scores a run recorded with -record (from real bots or simulated
+// ones with -simulate, the recording is the same) against the ground truth of
+// -truth: where the bots really were and where the walls are. It prints a report, and
+// writes it as json to -report, so two versions of xcorr, quadlaterate or a
+// policy can be run over the same room and compared
+//  -- the server's frame is wherever bot 0 started, so the truth gives where
+//     that is in the room ("frame"), or it is fitted to the truth poses
+//  -- localization: each truth pose against the bot's estimate at that
+//     step of its trajectory or, by time, the last one before it
+//  -- ATE: rms position error over every truth pose, after the frame
+//  -- RPE: error of the motion between consecutive truth poses of a bot,
+//     which no frame can hide
+//  -- map: precision is the share of occupied cells within evalTolerance
+//     cells of a wall, recall the share of wall cells within evalTolerance
+//     of an occupied cell, coverage the share of the walls' bounding box
+//     known; all three every evalEvery through the run
+
+// ground truth json
+type groundTruth struct {
+	Frame *pose      `json:"frame"` // where the server's origin sits in the room, cm and degrees
+	Walls []wall     `json:"walls"` // cm, in the room
+	Bots  []truthBot `json:"bots"`
+}
+
+type wall struct {
+	X0 float64 `json:"x0"`
+	Y0 float64 `json:"y0"`
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+}
+
+type truthBot struct {
+	ID    int         `json:"id"`
+	Poses []truthPose `json:"poses"`
+}
+
+// a true pose, at a step of the bot's trajectory (its index in GET
+// /bots/{id}/trajectory, every move adds one) or at a server millisecond
+// timestamp
+type truthPose struct {
+	Step *int    `json:"step,omitempty"`
+	Time int64   `json:"time,omitempty"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	R    float64 `json:"r"`
+}
+
+// evaluation report json
+type evalReport struct {
+	Run         string     `json:"run"`
+	Truth       string     `json:"truth"`
+	Seconds     float64    `json:"seconds"` // how long the recording ran
+	Frame       pose       `json:"frame"`
+	FrameFitted bool       `json:"framefitted"`
+	Bots        []botScore `json:"bots"`
+	ATE         float64    `json:"ate"`      // cm
+	RPETrans    float64    `json:"rpetrans"` // cm, rms
+	RPERot      float64    `json:"rperot"`   // degrees, rms
+	Map         *mapScore  `json:"map,omitempty"`
+	Timeline    []mapScore `json:"timeline,omitempty"`
+	Dropped     int        `json:"dropped,omitempty"` // events the recorder missed
+}
+
+type botScore struct {
+	ID          int     `json:"id"`
+	Matched     int     `json:"matched"`   // truth poses the run has an estimate for
+	Unmatched   int     `json:"unmatched"` // and those it does not
+	MeanErr     float64 `json:"meanerr"`   // cm
+	ATE         float64 `json:"ate"`       // cm, rms
+	MaxErr      float64 `json:"maxerr"`
+	FinalErr    float64 `json:"finalerr"`
+	MeanHeading float64 `json:"meanheading"` // degrees
+	MaxHeading  float64 `json:"maxheading"`
+	RPETrans    float64 `json:"rpetrans"` // cm, rms
+	RPERot      float64 `json:"rperot"`   // degrees, rms
+	RPEPairs    int     `json:"rpepairs"`
+}
+
+type mapScore struct {
+	Time      float64 `json:"time"` // s into the recording
+	Occupied  int     `json:"occupied"`
+	Walls     int     `json:"walls"` // wall cells in the truth
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	Coverage  float64 `json:"coverage"`
+}
+
+var (
+	evalTolerance int           = 1 // cells
+	evalEvery     time.Duration = 10 * time.Second
+)
+
+type timedPose struct {
+	time int64
+	p    pose
+}
+
+type mapChange struct {
+	time  int64
+	cells []cellValue
+}
+
+// recording is a run read back from -record
+type recording struct {
+	start, end     int64
+	xscale, yscale float64
+	cells          map[cell]float64     // the map when recording started
+	changes        []mapChange          // oldest first
+	poses          map[int][]timedPose  // [botID] -> estimates, oldest first
+	steps          map[int]map[int]pose // [botID] -> [step] -> trajectory pose
+	dropped        int
+}
+
+// readRecording reads a file written by -record
+func readRecording(filename string) (*recording, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rec := &recording{
+		xscale: xscale,
+		yscale: yscale,
+		cells:  make(map[cell]float64),
+		poses:  make(map[int][]timedPose),
+		steps:  make(map[int]map[int]pose),
+	}
+	dec := json.NewDecoder(f)
+	for line := 1; ; line++ {
+		var ev struct {
+			Type string          `json:"type"`
+			Time int64           `json:"time"`
+			Bot  *int            `json:"bot"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("event %v: %v", line, err)
+		}
+		if line == 1 && ev.Type != "snapshot" {
+			return nil, fmt.Errorf("does not start with a snapshot, was it written by -record?")
+		}
+		if rec.start == 0 {
+			rec.start = ev.Time
+		}
+		rec.end = ev.Time
+		if err := rec.add(ev.Type, ev.Time, ev.Bot, ev.Data); err != nil {
+			return nil, fmt.Errorf("event %v (%v): %v", line, ev.Type, err)
+		}
+	}
+	if rec.start == 0 {
+		return nil, fmt.Errorf("empty recording")
+	}
+	return rec, nil
+}
+
+// add replays one event; the ones that say nothing of poses or the map are
+// skipped
+func (rec *recording) add(typ string, t int64, botID *int, data json.RawMessage) error {
+	switch typ {
+	case "snapshot":
+		s := snapshot{}
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s.XScale > 0 && s.YScale > 0 {
+			rec.xscale, rec.yscale = s.XScale, s.YScale
+		}
+		for _, c := range s.Cells {
+			rec.cells[cell{x: c.X, y: c.Y}] = c.L
+		}
+		for id, p := range s.Poses {
+			rec.poses[id] = append(rec.poses[id], timedPose{time: t, p: p})
+		}
+		for id, tr := range s.Traj {
+			for step, p := range tr {
+				rec.step(id, step, p)
+			}
+		}
+	case "dropped":
+		d := struct {
+			Dropped int `json:"dropped"`
+		}{}
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		rec.dropped += d.Dropped
+	case evOGM:
+		cvs := []cellValue{}
+		if err := json.Unmarshal(data, &cvs); err != nil {
+			return err
+		}
+		rec.changes = append(rec.changes, mapChange{time: t, cells: cvs})
+	case evPose:
+		pd := struct {
+			Pose pose `json:"pose"`
+			Step int  `json:"step"`
+		}{}
+		if botID == nil {
+			return fmt.Errorf("no bot")
+		}
+		if err := json.Unmarshal(data, &pd); err != nil {
+			return err
+		}
+		rec.poses[*botID] = append(rec.poses[*botID], timedPose{time: t, p: pd.Pose})
+		rec.step(*botID, pd.Step, pd.Pose)
+	case evLocalization:
+		fix := poseFix{}
+		if botID == nil {
+			return fmt.Errorf("no bot")
+		}
+		if err := json.Unmarshal(data, &fix); err != nil {
+			return err
+		}
+		rec.poses[*botID] = append(rec.poses[*botID], timedPose{time: t, p: fix.Pose})
+	}
+	return nil
+}
+
+func (rec *recording) step(botID, step int, p pose) {
+	if rec.steps[botID] == nil {
+		rec.steps[botID] = make(map[int]pose)
+	}
+	rec.steps[botID][step] = p
+}
+
+// estimate is what the run thought tp of botID was
+func (rec *recording) estimate(botID int, tp truthPose) (pose, bool) {
+	if tp.Step != nil {
+		p, ok := rec.steps[botID][*tp.Step]
+		return p, ok
+	}
+	ps := rec.poses[botID]
+	i := sort.Search(len(ps), func(i int) bool { return ps[i].time > tp.Time })
+	if i == 0 {
+		return pose{}, false
+	}
+	return ps[i-1].p, true
+}
+
+// toRoom takes p from the server's frame into the room, the server's
+// origin sitting at frame
+func toRoom(frame, p pose) pose {
+	th := frame.r * math.Pi / 180
+	return pose{
+		x: frame.x + p.x*math.Cos(th) - p.y*math.Sin(th),
+		y: frame.y + p.x*math.Sin(th) + p.y*math.Cos(th),
+		r: p.r + frame.r,
+	}
+}
+
+// angleDiff is a - b in degrees, the short way round
+func angleDiff(a, b float64) float64 {
+	return math.Mod(math.Mod(a-b, 360)+540, 360) - 180
+}
+
+// fitFrame is the turn and shift that best lays the estimates onto the
+// truth, by least squares; a single place only lines up by heading
+func fitFrame(est, truth []pose) (pose, error) {
+	n := float64(len(est))
+	if n == 0 {
+		return pose{}, fmt.Errorf("no truth pose has an estimate in the run, give the frame")
+	}
+	var ex, ey, tx, ty float64
+	for i := range est {
+		ex, ey = ex+est[i].x/n, ey+est[i].y/n
+		tx, ty = tx+truth[i].x/n, ty+truth[i].y/n
+	}
+	var dot, cross float64
+	for i := range est {
+		px, py := est[i].x-ex, est[i].y-ey
+		qx, qy := truth[i].x-tx, truth[i].y-ty
+		dot += px*qx + py*qy
+		cross += px*qy - py*qx
+	}
+	th := math.Atan2(cross, dot)
+	if math.Hypot(dot, cross) < 1 {
+		th = angleDiff(truth[0].r, est[0].r) * math.Pi / 180
+	}
+	return pose{
+		x: tx - (ex*math.Cos(th) - ey*math.Sin(th)),
+		y: ty - (ex*math.Sin(th) + ey*math.Cos(th)),
+		r: th * 180 / math.Pi,
+	}, nil
+}
+
+// relative is b as seen from a
+func relative(a, b pose) pose {
+	th := a.r * math.Pi / 180
+	dx, dy := b.x-a.x, b.y-a.y
+	return pose{
+		x: dx*math.Cos(th) + dy*math.Sin(th),
+		y: -dx*math.Sin(th) + dy*math.Cos(th),
+		r: angleDiff(b.r, a.r),
+	}
+}
+
+// roomCell is the cell of the room at x, y cm
+func (rec *recording) roomCell(x, y float64) cell {
+	return cell{x: int(math.Floor(x / rec.xscale)), y: int(math.Floor(y / rec.yscale))}
+}
+
+// wallCells rasterizes the walls, and the bounding box coverage is over
+func (rec *recording) wallCells(walls []wall) (map[cell]bool, cell, cell) {
+	cells := make(map[cell]bool)
+	min, max := cell{x: math.MaxInt32, y: math.MaxInt32}, cell{x: math.MinInt32, y: math.MinInt32}
+	for _, w := range walls {
+		for _, c := range lineCells(rec.roomCell(w.X0, w.Y0), rec.roomCell(w.X1, w.Y1)) {
+			cells[c] = true
+			min.x, min.y = int(math.Min(float64(min.x), float64(c.x))), int(math.Min(float64(min.y), float64(c.y)))
+			max.x, max.y = int(math.Max(float64(max.x), float64(c.x))), int(math.Max(float64(max.y), float64(c.y)))
+		}
+	}
+	return cells, min, max
+}
+
+// near reports whether set has a cell within evalTolerance of c
+func near(set map[cell]bool, c cell) bool {
+	for dx := -evalTolerance; dx <= evalTolerance; dx++ {
+		for dy := -evalTolerance; dy <= evalTolerance; dy++ {
+			if set[cell{x: c.x + dx, y: c.y + dy}] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scoreMap compares the map m, in the server's frame, with the walls
+func (rec *recording) scoreMap(m map[cell]float64, frame pose, walls map[cell]bool, min, max cell) mapScore {
+	occupied, known := make(map[cell]bool), make(map[cell]bool)
+	for c, v := range m {
+		if math.Abs(v) < knownThresh {
+			continue
+		}
+		// the cell's center, in the room
+		p := toRoom(frame, pose{x: (float64(c.x) + 0.5) * rec.xscale, y: (float64(c.y) + 0.5) * rec.yscale})
+		rc := rec.roomCell(p.x, p.y)
+		if v >= occThresh {
+			occupied[rc] = true
+		}
+		if rc.x >= min.x && rc.x <= max.x && rc.y >= min.y && rc.y <= max.y {
+			known[rc] = true
+		}
+	}
+	ms := mapScore{Occupied: len(occupied), Walls: len(walls)}
+	hits := 0
+	for c := range occupied {
+		if near(walls, c) {
+			hits++
+		}
+	}
+	if len(occupied) > 0 {
+		ms.Precision = float64(hits) / float64(len(occupied))
+	}
+	found := 0
+	for c := range walls {
+		if near(occupied, c) {
+			found++
+		}
+	}
+	if len(walls) > 0 {
+		ms.Recall = float64(found) / float64(len(walls))
+		ms.Coverage = float64(len(known)) / float64((max.x-min.x+1)*(max.y-min.y+1))
+	}
+	return ms
+}
+
+// readTruth reads a ground truth file
+func readTruth(filename string) (*groundTruth, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	truth := &groundTruth{}
+	if err := json.Unmarshal(b, truth); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return truth, nil
+}
+
+// evaluate scores the recording runFile against truthFile
+func evaluate(runFile, truthFile string) (*evalReport, error) {
+	truth, err := readTruth(truthFile)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := readRecording(runFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", runFile, err)
+	}
+	report := &evalReport{Run: runFile, Truth: truthFile, Seconds: float64(rec.end-rec.start) / 1000, Dropped: rec.dropped}
+	// pair every truth pose with its estimate
+	ests := make([][]pose, len(truth.Bots))
+	trues := make([][]pose, len(truth.Bots))
+	var allEst, allTrue []pose
+	for i, tb := range truth.Bots {
+		for _, tp := range tb.Poses {
+			if p, ok := rec.estimate(tb.ID, tp); ok {
+				ests[i] = append(ests[i], p)
+				trues[i] = append(trues[i], pose{x: tp.X, y: tp.Y, r: tp.R})
+			}
+		}
+		allEst, allTrue = append(allEst, ests[i]...), append(allTrue, trues[i]...)
+	}
+	if truth.Frame != nil {
+		report.Frame = *truth.Frame
+	} else if len(truth.Bots) > 0 {
+		if report.Frame, err = fitFrame(allEst, allTrue); err != nil {
+			return nil, err
+		}
+		report.FrameFitted = true
+	}
+	var sq, rpeSq, rotSq float64
+	pairs := 0
+	for i, tb := range truth.Bots {
+		bs := botScore{ID: tb.ID, Matched: len(ests[i]), Unmatched: len(tb.Poses) - len(ests[i])}
+		var bsq, brpe, brot float64
+		for j := range ests[i] {
+			e := toRoom(report.Frame, ests[i][j])
+			t := trues[i][j]
+			d := math.Hypot(e.x-t.x, e.y-t.y)
+			h := math.Abs(angleDiff(e.r, t.r))
+			bs.MeanErr += d / float64(bs.Matched)
+			bs.MeanHeading += h / float64(bs.Matched)
+			bs.MaxErr = math.Max(bs.MaxErr, d)
+			bs.MaxHeading = math.Max(bs.MaxHeading, h)
+			bs.FinalErr = d
+			bsq += d * d
+			if j == 0 {
+				continue
+			}
+			re, rt := relative(ests[i][j-1], ests[i][j]), relative(trues[i][j-1], t)
+			dt, dr := math.Hypot(re.x-rt.x, re.y-rt.y), angleDiff(re.r, rt.r)
+			brpe += dt * dt
+			brot += dr * dr
+			bs.RPEPairs++
+		}
+		if bs.Matched > 0 {
+			bs.ATE = math.Sqrt(bsq / float64(bs.Matched))
+		}
+		if bs.RPEPairs > 0 {
+			bs.RPETrans = math.Sqrt(brpe / float64(bs.RPEPairs))
+			bs.RPERot = math.Sqrt(brot / float64(bs.RPEPairs))
+		}
+		sq, rpeSq, rotSq, pairs = sq+bsq, rpeSq+brpe, rotSq+brot, pairs+bs.RPEPairs
+		report.Bots = append(report.Bots, bs)
+	}
+	if len(allEst) > 0 {
+		report.ATE = math.Sqrt(sq / float64(len(allEst)))
+	}
+	if pairs > 0 {
+		report.RPETrans = math.Sqrt(rpeSq / float64(pairs))
+		report.RPERot = math.Sqrt(rotSq / float64(pairs))
+	}
+	if len(truth.Walls) == 0 {
+		return report, nil
+	}
+	// replay the map, scoring it every evalEvery
+	walls, min, max := rec.wallCells(truth.Walls)
+	m := make(map[cell]float64)
+	for c, v := range rec.cells {
+		m[c] = v
+	}
+	every := evalEvery.Milliseconds()
+	next := rec.start
+	score := func(t int64) {
+		ms := rec.scoreMap(m, report.Frame, walls, min, max)
+		ms.Time = float64(t-rec.start) / 1000
+		report.Timeline = append(report.Timeline, ms)
+	}
+	for _, ch := range rec.changes {
+		for every > 0 && ch.time >= next {
+			score(next)
+			next += every
+		}
+		for _, cv := range ch.cells {
+			m[cell{x: cv.X, y: cv.Y}] = cv.L
+		}
+	}
+	final := rec.scoreMap(m, report.Frame, walls, min, max)
+	final.Time = report.Seconds
+	report.Map = &final
+	report.Timeline = append(report.Timeline, final)
+	return report, nil
+}
+
+// printReport writes r for people
+func printReport(w io.Writer, r *evalReport) {
+	how := "given"
+	if r.FrameFitted {
+		how = "fitted"
+	}
+	fmt.Fprintf(w, "run %v against %v, %.1f s\n", r.Run, r.Truth, r.Seconds)
+	fmt.Fprintf(w, "frame %.1f, %.1f cm, %.1f degrees (%v)\n", r.Frame.x, r.Frame.y, r.Frame.r, how)
+	if r.Dropped > 0 {
+		fmt.Fprintf(w, "warning: the recorder missed %v events\n", r.Dropped)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nBOT\tPOSES\tMEAN CM\tATE CM\tMAX CM\tFINAL CM\tMEAN DEG\tMAX DEG\tRPE CM\tRPE DEG")
+	for _, b := range r.Bots {
+		fmt.Fprintf(tw, "%v\t%v/%v\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n", b.ID, b.Matched, b.Matched+b.Unmatched,
+			b.MeanErr, b.ATE, b.MaxErr, b.FinalErr, b.MeanHeading, b.MaxHeading, b.RPETrans, b.RPERot)
+	}
+	fmt.Fprintf(tw, "all\t\t\t%.1f\t\t\t\t\t%.1f\t%.1f\n", r.ATE, r.RPETrans, r.RPERot)
+	tw.Flush()
+	if r.Map == nil {
+		return
+	}
+	fmt.Fprintf(w, "\nmap: precision %.2f, recall %.2f (within %v cells of %v wall cells), coverage %.2f\n",
+		r.Map.Precision, r.Map.Recall, evalTolerance, r.Map.Walls, r.Map.Coverage)
+	fmt.Fprintln(tw, "\nS\tOCCUPIED\tPRECISION\tRECALL\tCOVERAGE")
+	for _, ms := range r.Timeline {
+		fmt.Fprintf(tw, "%.0f\t%v\t%.2f\t%.2f\t%.2f\n", ms.Time, ms.Occupied, ms.Precision, ms.Recall, ms.Coverage)
+	}
+	tw.Flush()
+}
+
+// runEval is -eval: score, print, and write the json report if asked
+func runEval(runFile, truthFile, reportFile string) error {
+	if truthFile == "" {
+		return fmt.Errorf("-eval needs -truth")
+	}
+	r, err := evaluate(runFile, truthFile)
+	if err != nil {
+		return err
+	}
+	printReport(os.Stdout, r)
+	if reportFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reportFile, append(b, '\n'), 0644)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func samePose(a, b pose) bool {
+	return math.Abs(a.x-b.x) < 1e-6 && math.Abs(a.y-b.y) < 1e-6 && math.Abs(angleDiff(a.r, b.r)) < 1e-6
+}
+
+func TestFitFrame(t *testing.T) {
+	est := []pose{{0, 0, 0}, {100, 0, 0}, {100, 50, 90}, {20, 80, 180}}
+	tests := []struct {
+		name    string
+		est     []pose
+		frame   pose // truth is est seen from frame
+		wantErr bool
+	}{
+		{name: "identity", est: est, frame: pose{}},
+		{name: "shifted", est: est, frame: pose{10, -5, 0}},
+		{name: "turned and shifted", est: est, frame: pose{100, 50, 90}},
+		{name: "turned back", est: est, frame: pose{-30, 12, -45}},
+		{name: "one pose, heading only", est: est[2:3], frame: pose{5, 5, 30}},
+		{name: "nothing to fit", est: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			truth := []pose{}
+			for _, p := range tt.est {
+				truth = append(truth, toRoom(tt.frame, p))
+			}
+			got, err := fitFrame(tt.est, truth)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("fitFrame = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fitFrame: %v", err)
+			}
+			// a single pose only fixes the heading, check it lands right
+			if len(tt.est) == 1 {
+				if r := toRoom(got, tt.est[0]); !samePose(r, truth[0]) {
+					t.Fatalf("fitFrame = %v puts %v at %v, want %v", got, tt.est[0], r, truth[0])
+				}
+				return
+			}
+			if !samePose(got, tt.frame) {
+				t.Fatalf("fitFrame = %v, want %v", got, tt.frame)
+			}
+		})
+	}
+}
+
+// writeEvalRun writes a recording of bot 0 stepping through est, a truth file
+// of where it really was, and returns their names
+func writeEvalRun(t *testing.T, est, truth []pose, frame *pose) (string, string) {
+	dir := t.TempDir()
+	events := []string{`{"type":"snapshot","time":1000,"data":{"xscale":10,"yscale":10}}`}
+	gt := groundTruth{Frame: frame, Bots: []truthBot{{ID: 0}}}
+	for i := range est {
+		b, _ := json.Marshal(map[string]interface{}{
+			"type": evPose, "time": 1000 + int64(i)*100, "bot": 0,
+			"data": map[string]interface{}{"pose": est[i], "step": i},
+		})
+		events = append(events, string(b))
+		step := i
+		gt.Bots[0].Poses = append(gt.Bots[0].Poses, truthPose{Step: &step, X: truth[i].x, Y: truth[i].y, R: truth[i].r})
+	}
+	runFile := filepath.Join(dir, "run.jsonl")
+	if err := os.WriteFile(runFile, []byte(strings.Join(events, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(gt)
+	truthFile := filepath.Join(dir, "truth.json")
+	if err := os.WriteFile(truthFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return runFile, truthFile
+}
+
+func TestEvaluate(t *testing.T) {
+	est := []pose{{0, 0, 90}, {0, 50, 90}, {0, 100, 90}, {0, 100, 0}}
+	offset := []pose{}
+	for _, p := range est {
+		offset = append(offset, pose{p.x + 3, p.y + 4, p.r})
+	}
+	tests := []struct {
+		name    string
+		truth   []pose
+		frame   *pose
+		wantATE float64
+		wantRPE float64
+		wantFit bool
+		wantBad bool // not a recording
+	}{
+		{name: "perfect", truth: est, frame: &pose{}, wantATE: 0},
+		{name: "off by 5 cm, frame given", truth: offset, frame: &pose{}, wantATE: 5},
+		{name: "off by 5 cm, frame fitted", truth: offset, wantATE: 0, wantFit: true},
+		{name: "not a recording", truth: est, wantBad: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runFile, truthFile := writeEvalRun(t, est, tt.truth, tt.frame)
+			if tt.wantBad {
+				// the truth is no recording
+				if _, err := evaluate(truthFile, truthFile); err == nil {
+					t.Fatalf("evaluate took %v for a recording", truthFile)
+				}
+				return
+			}
+			r, err := evaluate(runFile, truthFile)
+			if err != nil {
+				t.Fatalf("evaluate: %v", err)
+			}
+			if len(r.Bots) != 1 || r.Bots[0].Matched != len(est) {
+				t.Fatalf("evaluate matched %+v, want all %v poses of bot 0", r.Bots, len(est))
+			}
+			if math.Abs(r.ATE-tt.wantATE) > 1e-6 || math.Abs(r.RPETrans-tt.wantRPE) > 1e-6 {
+				t.Fatalf("evaluate ATE %v RPE %v, want %v and %v", r.ATE, r.RPETrans, tt.wantATE, tt.wantRPE)
+			}
+			if r.FrameFitted != tt.wantFit {
+				t.Fatalf("evaluate fitted the frame: %v, want %v", r.FrameFitted, tt.wantFit)
+			}
+		})
+	}
+}
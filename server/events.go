@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *** EVENTS ***
+
+// everything worth watching is published as a typed event, and GET /events
+// streams them to whoever subscribes as server-sent events. Publishing
+// never blocks: a subscriber that cannot keep up loses events (and is told
+// how many with a "dropped" event)
+
+const (
+	evRegister     = "register"     // a bot registered: {id, ip}
+	evMov          = "mov"          // a /mov callback, as the bot posted it
+	evUltrasonic   = "ultrasonic"   // a reading: {z} cm
+	evOGM          = "ogm"          // cells a reading changed: [{x, y, l}]
+	evPlan         = "plan"         // a new path: {goal, path}
+	evState        = "state"        // a bot changed state: {from, to, why}
+	evLocalization = "localization" // a pose was fixed: {source, pose, sigmaxy}
+	evError        = "error"        // something failed: {error}
+	evDiagnostic   = "diagnostic"   // a bring-up check's result, see diagnostics.go
+	evPose         = "pose"         // a pose added to a trajectory: {pose, step}
+)
+
+var eventTypes = []string{evRegister, evMov, evUltrasonic, evOGM, evPlan, evState, evLocalization, evError, evDiagnostic, evPose}
+
+// event json
+type event struct {
+	ID   int64       `json:"id"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`          // server millisecond timestamp
+	Bot  *int        `json:"bot,omitempty"` // the bot it is about, if any
+	Data interface{} `json:"data"`
+}
+
+type subscriber struct {
+	ch      chan *event
+	types   map[string]bool // nil for all
+	dropped int
+}
+
+var (
+	eventLock   sync.Mutex // guards subscribers and eventCount
+	subscribers = make(map[*subscriber]bool)
+	eventCount  int64
+
+	eventBuffer    int           = 256              // events a subscriber may fall behind by
+	eventKeepalive time.Duration = 15 * time.Second // comment sent on a quiet stream
+)
+
+// publish sends an event about botID (-1 for none) to every subscriber
+func publish(typ string, botID int, data interface{}) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+	eventCount++
+	ev := &event{ID: eventCount, Type: typ, Time: makeTimestamp(), Data: data}
+	if botID >= 0 {
+		ev.Bot = &botID
+	}
+	for sub := range subscribers {
+		if sub.types != nil && !sub.types[typ] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// publishError publishes err as an error event about botID
+func publishError(botID int, err string) {
+	publish(evError, botID, map[string]string{"error": err})
+}
+
+// subscribe starts collecting the events of types (all when empty)
+func subscribe(types []string) *subscriber {
+	return subscribeBuffered(types, eventBuffer)
+}
+
+// subscribeBuffered is subscribe for a subscriber that may fall behind by
+// buffer events
+func subscribeBuffered(types []string, buffer int) *subscriber {
+	sub := &subscriber{ch: make(chan *event, buffer)}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool)
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	eventLock.Lock()
+	subscribers[sub] = true
+	eventLock.Unlock()
+	return sub
+}
+
+func unsubscribe(sub *subscriber) {
+	eventLock.Lock()
+	delete(subscribers, sub)
+	eventLock.Unlock()
+}
+
+// takeDropped returns (and resets) how many events sub missed
+func (sub *subscriber) takeDropped() int {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	d := sub.dropped
+	sub.dropped = 0
+	return d
+}
+
+// parseEventTypes reads a comma separated ?type= filter
+func parseEventTypes(q string) ([]string, error) {
+	if q == "" {
+		return nil, nil
+	}
+	types := strings.Split(q, ",")
+	for _, t := range types {
+		known := false
+		for _, et := range eventTypes {
+			known = known || t == et
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q (have %v)", t, strings.Join(eventTypes, ", "))
+		}
+	}
+	return types, nil
+}
+
+// streamEvents sends the events as server-sent events until the client
+// goes away
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming unsupported!\n"))
+		return
+	}
+	types, err := parseEventTypes(r.URL.Query().Get("type"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	sub := subscribe(types)
+	defer unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev := <-sub.ch:
+			if d := sub.takeDropped(); d > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", d)
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				fmt.Printf(" streamEvents error -- %v\n", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// localization event json
+type poseFix struct {
+	Source  string  `json:"source"` // localize, range, mcl, merge, assumed or simulate
+	Pose    pose    `json:"pose"`
+	SigmaXY float64 `json:"sigmaxy"` // cm
+}
+
+// publishFix publishes botID's pose as fixed by source (caller must hold
+// stateLock)
+func publishFix(botID int, source string) {
+	publish(evLocalization, botID, poseFix{Source: source, Pose: pos[botID], SigmaXY: positionSigma(botID)})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// *** FRONTIER EXPLORATION ***
+
+var knownThresh float64 = 0.5 // |log-odds| below this is unknown
+
+// frontier: go where the known free space meets unknown space
+//  -- cluster free cells adjacent to unknown cells
+//  -- score each cluster by information gain - lambda * path cost
+
+type frontierPolicy struct {
+	minSize    int                   // smaller frontier clusters are noise
+	maxSize    int                   // larger ones are split, so bots can share a long frontier
+	infoRadius int                   // cells around a goal counted as information gain
+	lambda     float64               // information gain traded per cell of path cost
+	failed     map[int]map[cell]bool // [botID] -> goals plan could not reach
+}
+
+func newFrontierPolicy(params policyParams) (Policy, error) {
+	fp := &frontierPolicy{
+		minSize:    int(params.get("minsize", 2)),
+		maxSize:    int(params.get("maxsize", 12)),
+		infoRadius: int(params.get("inforadius", 3)),
+		lambda:     params.get("lambda", 0.5),
+		failed:     make(map[int]map[cell]bool),
+	}
+	if fp.minSize < 1 || fp.maxSize < fp.minSize || fp.infoRadius < 0 || fp.lambda < 0 {
+		return nil, fmt.Errorf("frontier: need 1 <= minsize <= maxsize, inforadius and lambda >= 0")
+	}
+	return fp, nil
+}
+
+func (fp *frontierPolicy) OnMeasurement(botID int, from, hit cell) {}
+
+func (fp *frontierPolicy) OnPlanFailed(botID int, goal cell) {
+	if fp.failed[botID] == nil {
+		fp.failed[botID] = make(map[cell]bool)
+	}
+	fp.failed[botID][goal] = true
+}
+
+func isUnknown(c cell) bool {
+	return math.Abs(ogm[c]) < knownThresh
+}
+
+func isFree(c cell) bool {
+	return ogm[c] <= -knownThresh
+}
+
+// traversable is anything not (yet) occupied, unknown space is allowed
+func traversable(c cell) bool {
+	return ogm[c] < occThresh
+}
+
+var neighbors4 = []cell{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+var neighbors8 = []cell{{1, 0}, {-1, 0}, {0, 1}, {0, -1}, {1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
+
+func add(a, b cell) cell {
+	return cell{x: a.x + b.x, y: a.y + b.y}
+}
+
+// knownBounds returns the cell bounding box of the known map, grown by 1
+func knownBounds() (cell, cell, bool) {
+	lo := cell{x: math.MaxInt32, y: math.MaxInt32}
+	hi := cell{x: math.MinInt32, y: math.MinInt32}
+	found := false
+	for k := range ogm {
+		if isUnknown(k) {
+			continue
+		}
+		found = true
+		if k.x < lo.x {
+			lo.x = k.x
+		}
+		if k.y < lo.y {
+			lo.y = k.y
+		}
+		if k.x > hi.x {
+			hi.x = k.x
+		}
+		if k.y > hi.y {
+			hi.y = k.y
+		}
+	}
+	return cell{x: lo.x - 1, y: lo.y - 1}, cell{x: hi.x + 1, y: hi.y + 1}, found
+}
+
+// boundsWith grows the box [lo, hi] to contain cs
+func boundsWith(lo, hi cell, cs ...cell) (cell, cell) {
+	for _, c := range cs {
+		if c.x < lo.x {
+			lo.x = c.x
+		}
+		if c.y < lo.y {
+			lo.y = c.y
+		}
+		if c.x > hi.x {
+			hi.x = c.x
+		}
+		if c.y > hi.y {
+			hi.y = c.y
+		}
+	}
+	return lo, hi
+}
+
+func inBounds(c, lo, hi cell) bool {
+	return c.x >= lo.x && c.x <= hi.x && c.y >= lo.y && c.y <= hi.y
+}
+
+// frontierCells are free cells with at least one unknown 4-neighbor
+func frontierCells() []cell {
+	frontier := make([]cell, 0)
+	for k := range ogm {
+		if !isFree(k) {
+			continue
+		}
+		for _, d := range neighbors4 {
+			if isUnknown(add(k, d)) {
+				frontier = append(frontier, k)
+				break
+			}
+		}
+	}
+	return frontier
+}
+
+// clusterFrontiers groups 8-connected frontier cells into clusters of at
+// most maxSize cells
+func clusterFrontiers(frontier []cell, minSize, maxSize int) [][]cell {
+	isFrontier := make(map[cell]bool)
+	for _, c := range frontier {
+		isFrontier[c] = true
+	}
+	seen := make(map[cell]bool)
+	clusters := make([][]cell, 0)
+	for i := 0; i < len(frontier); i++ {
+		c := frontier[i]
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		cluster := []cell{}
+		Q := []cell{c}
+		for len(Q) > 0 && len(cluster) < maxSize {
+			node := Q[0]
+			Q = Q[1:]
+			cluster = append(cluster, node)
+			for _, d := range neighbors8 {
+				next := add(node, d)
+				if isFrontier[next] && !seen[next] {
+					seen[next] = true
+					Q = append(Q, next)
+				}
+			}
+		}
+		// whatever did not fit starts the next cluster
+		for _, left := range Q {
+			seen[left] = false
+			frontier = append(frontier, left)
+		}
+		if len(cluster) >= minSize {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// clusterTarget is the cluster member closest to the cluster centroid, since
+// the centroid itself may not be a frontier, or even free
+func clusterTarget(cluster []cell) cell {
+	cx, cy := 0.0, 0.0
+	for _, c := range cluster {
+		cx += float64(c.x)
+		cy += float64(c.y)
+	}
+	cx /= float64(len(cluster))
+	cy /= float64(len(cluster))
+	best := cluster[0]
+	bestD := math.MaxFloat64
+	for _, c := range cluster {
+		if d := euclDist(cx, cy, float64(c.x), float64(c.y)); d < bestD {
+			best = c
+			bestD = d
+		}
+	}
+	return best
+}
+
+// pathCosts runs a breadth-first search from start over traversable cells
+// inside [lo, hi] that are not blocked, and returns the step count to every
+// reached cell
+func pathCosts(start cell, lo, hi cell, blocked map[cell]bool) map[cell]int {
+	cost := map[cell]int{start: 0}
+	Q := []cell{start}
+	for len(Q) > 0 {
+		node := Q[0]
+		Q = Q[1:]
+		for _, d := range neighbors8 {
+			next := add(node, d)
+			if _, ok := cost[next]; ok || !inBounds(next, lo, hi) || !traversable(next) || blocked[next] {
+				continue
+			}
+			cost[next] = cost[node] + 1
+			Q = append(Q, next)
+		}
+	}
+	return cost
+}
+
+// informationGain counts unknown cells within radius of c
+func informationGain(c cell, radius int) int {
+	gain := 0
+	for i := -radius; i <= radius; i++ {
+		for j := -radius; j <= radius; j++ {
+			if i*i+j*j <= radius*radius && isUnknown(cell{x: c.x + i, y: c.y + j}) {
+				gain++
+			}
+		}
+	}
+	return gain
+}
+
+// NextGoal picks the frontier cluster with the best information gain
+// against path cost, over the cells plan may use, falling back to a random
+// goal when nothing is reachable
+func (fp *frontierPolicy) NextGoal(botID int, from cell) (cell, bool) {
+	lo, hi, ok := knownBounds()
+	if !ok {
+		return randomGoal(from, 10, 2), true
+	}
+	// let the search start from the bot even if it sits outside the known map
+	lo, hi = boundsWith(lo, hi, from)
+	cost := pathCosts(from, lo, hi, planBlocked(botID))
+	best := from
+	bestScore := math.Inf(-1)
+	for _, cluster := range clusterFrontiers(frontierCells(), fp.minSize, fp.maxSize) {
+		target := clusterTarget(cluster)
+		c, reachable := cost[target]
+		if !reachable || c == 0 || fp.failed[botID][target] {
+			continue
+		}
+		score := float64(informationGain(target, fp.infoRadius)) - fp.lambda*float64(c)
+		if score > bestScore {
+			best = target
+			bestScore = score
+		}
+	}
+	if math.IsInf(bestScore, -1) {
+		fmt.Printf(" bot %v: no reachable frontier, picking a random goal.\n", botID)
+		return randomGoal(from, 10, 2), true
+	}
+	fmt.Printf(" bot %v: frontier goal %v (score %.1f)\n", botID, best, bestScore)
+	return best, true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// knownFree marks every cell of the box [lo, hi] as known free
+func knownFree(m map[cell]float64, lo, hi cell) {
+	for x := lo.x; x <= hi.x; x++ {
+		for y := lo.y; y <= hi.y; y++ {
+			m[cell{x: x, y: y}] = -2 * knownThresh
+		}
+	}
+}
+
+// sortCells orders cs by x, then y
+func sortCells(cs []cell) []cell {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].x != cs[j].x {
+			return cs[i].x < cs[j].x
+		}
+		return cs[i].y < cs[j].y
+	})
+	return cs
+}
+
+func TestFrontierCells(t *testing.T) {
+	defer func(m map[cell]float64) { ogm = m }(ogm)
+
+	tests := []struct {
+		name  string
+		free  [2]cell // box of known free cells
+		walls []cell
+		want  []cell
+	}{
+		{
+			name: "one cell",
+			free: [2]cell{{0, 0}, {0, 0}},
+			want: []cell{{0, 0}},
+		},
+		{
+			name: "the rim of a box",
+			free: [2]cell{{0, 0}, {2, 2}},
+			want: []cell{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {1, 2}, {2, 0}, {2, 1}, {2, 2}},
+		},
+		{
+			name:  "walled on one side",
+			free:  [2]cell{{0, 0}, {2, 0}},
+			walls: []cell{{0, 1}, {1, 1}, {2, 1}},
+			want:  []cell{{0, 0}, {1, 0}, {2, 0}},
+		},
+		{
+			name:  "walled in",
+			free:  [2]cell{{0, 0}, {0, 0}},
+			walls: []cell{{1, 0}, {-1, 0}, {0, 1}, {0, -1}},
+			want:  []cell{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			knownFree(ogm, tt.free[0], tt.free[1])
+			for _, w := range tt.walls {
+				ogm[w] = 2 * occThresh
+			}
+			if got := sortCells(frontierCells()); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("frontierCells = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterFrontiers(t *testing.T) {
+	line := func(x0, x1 int) []cell {
+		cs := []cell{}
+		for x := x0; x <= x1; x++ {
+			cs = append(cs, cell{x: x, y: 0})
+		}
+		return cs
+	}
+	tests := []struct {
+		name             string
+		frontier         []cell
+		minSize, maxSize int
+		want             []int // cluster sizes, largest first
+	}{
+		{name: "none", frontier: nil, minSize: 1, maxSize: 10, want: []int{}},
+		{name: "one line", frontier: line(0, 4), minSize: 1, maxSize: 10, want: []int{5}},
+		{name: "diagonal neighbors join", frontier: []cell{{0, 0}, {1, 1}, {2, 2}}, minSize: 1, maxSize: 10, want: []int{3}},
+		{name: "two apart", frontier: append(line(0, 2), line(5, 8)...), minSize: 1, maxSize: 10, want: []int{4, 3}},
+		{name: "noise dropped", frontier: append(line(0, 0), line(5, 8)...), minSize: 2, maxSize: 10, want: []int{4}},
+		{name: "long one split", frontier: line(0, 9), minSize: 1, maxSize: 4, want: []int{4, 4, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := clusterFrontiers(tt.frontier, tt.minSize, tt.maxSize)
+			got := []int{}
+			seen := make(map[cell]bool)
+			for _, cl := range clusters {
+				got = append(got, len(cl))
+				for _, c := range cl {
+					if seen[c] {
+						t.Fatalf("clusterFrontiers = %v, %v is in two clusters", clusters, c)
+					}
+					seen[c] = true
+				}
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(got)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("clusterFrontiers = %v, sizes %v, want %v", clusters, got, tt.want)
+			}
+		})
+	}
+}
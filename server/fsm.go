@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// *** PER-ROBOT EXPLORATION STATE MACHINE ***
+
+//  Idle -> Sensing -> Planning -> Rotating -> Moving -> Sensing -> ...
+//                             \-> Blocked -> Moving (back off) / Sensing (retry)
+//                             \-> Idle (nothing left to do)
+//  any command that goes unanswered for movTimeout -> Failed
+//  Failed -> Sensing when the bot finally calls back
+
+type botState int
+
+const (
+	stateIdle botState = iota
+	stateRotating
+	stateMoving
+	stateSensing
+	statePlanning
+	stateBlocked
+	stateFailed
+)
+
+func (s botState) String() string {
+	switch s {
+	case stateIdle:
+		return "Idle"
+	case stateRotating:
+		return "Rotating"
+	case stateMoving:
+		return "Moving"
+	case stateSensing:
+		return "Sensing"
+	case statePlanning:
+		return "Planning"
+	case stateBlocked:
+		return "Blocked"
+	case stateFailed:
+		return "Failed"
+	}
+	return fmt.Sprintf("botState(%d)", int(s))
+}
+
+// transitions we expect, anything else is logged as suspicious
+var transitions = map[botState][]botState{
+	stateIdle:     {stateSensing},
+	stateSensing:  {statePlanning, stateFailed},
+	statePlanning: {stateRotating, stateBlocked, stateIdle, stateFailed},
+	stateRotating: {stateMoving, stateFailed},
+	stateMoving:   {stateSensing, stateFailed},
+	stateBlocked:  {stateMoving, stateSensing, stateFailed},
+	stateFailed:   {stateSensing},
+}
+
+var (
+	movTimeout time.Duration               = 30 * time.Second // longest a bot may take to answer a /mov
+	botStates  []botState                                     // [botID] -> state
+	movTimers  = make(map[int]*time.Timer)                    // [botID] -> pending /mov callback timeout
+)
+
+// expectedTransition reports whether from -> to is in the table; giving up
+// to Idle is always fine
+func expectedTransition(from, to botState) bool {
+	if to == stateIdle {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setState moves botID to s and logs the transition (caller must hold stateLock)
+func setState(botID int, s botState, why string) {
+	old := botStates[botID]
+	if old == s {
+		return
+	}
+	botStates[botID] = s
+	if expectedTransition(old, s) {
+		fmt.Printf("  bot %v: %v -> %v (%v)\n", botID, old, s, why)
+	} else {
+		fmt.Printf("  bot %v: %v -> %v (%v) UNEXPECTED\n", botID, old, s, why)
+	}
+	publish(evState, botID, map[string]string{"from": old.String(), "to": s.String(), "why": why})
+}
+
+// startMovTimer fails botID if it is still in state expect after movTimeout
+// (caller must hold stateLock)
+func startMovTimer(botID int, expect botState) {
+	stopMovTimer(botID)
+	var t *time.Timer
+	t = time.AfterFunc(movTimeout, func() {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		if movTimers[botID] != t || botStates[botID] != expect {
+			return // answered (or superseded) in the meantime
+		}
+		delete(movTimers, botID)
+		failBot(botID, fmt.Sprintf("no /mov callback after %v", movTimeout))
+	})
+	movTimers[botID] = t
+}
+
+// stopMovTimer cancels botID's pending timeout (caller must hold stateLock)
+func stopMovTimer(botID int) {
+	if t, ok := movTimers[botID]; ok {
+		t.Stop()
+		delete(movTimers, botID)
+	}
+}
+
+// failBot gives up on botID's current plan so nobody waits on it
+// (caller must hold stateLock)
+func failBot(botID int, why string) {
+	publishError(botID, why)
+	setState(botID, stateFailed, why)
+	stopMovTimer(botID)
+	paths[botID] = nil
+	releaseReservations(botID)
+	releaseBot(botID)
+}
+
+// sendMov puts botID in state next and sends it the movement command,
+// expecting a /mov callback within movTimeout; nothing is sent once the
+// exploration is stopped
+func sendMov(ctx context.Context, botID int, c movCMD, l int, next botState) {
+	if ctx.Err() != nil {
+		return
+	}
+	stateLock.Lock()
+	setState(botID, next, fmt.Sprintf("sent %v,%d", c, l))
+	startMovTimer(botID, next)
+	stateLock.Unlock()
+	if _, err := doMovPost(c, l, botID); err != nil {
+		stateLock.Lock()
+		if botStates[botID] == next {
+			failBot(botID, err.Error())
+		}
+		stateLock.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpectedTransition(t *testing.T) {
+	tests := []struct {
+		from, to botState
+		want     bool
+	}{
+		{stateIdle, stateSensing, true},
+		{stateSensing, statePlanning, true},
+		{statePlanning, stateRotating, true},
+		{stateRotating, stateMoving, true},
+		{stateMoving, stateSensing, true},
+		{statePlanning, stateBlocked, true},
+		{stateBlocked, stateMoving, true},
+		{stateBlocked, stateSensing, true},
+		{stateMoving, stateFailed, true},
+		{stateFailed, stateSensing, true},
+		{stateRotating, stateIdle, true},
+		{stateIdle, stateMoving, false},
+		{stateRotating, stateSensing, false},
+		{stateSensing, stateMoving, false},
+		{stateFailed, stateMoving, false},
+		{stateIdle, stateFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			if got := expectedTransition(tt.from, tt.to); got != tt.want {
+				t.Fatalf("expectedTransition(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovTimer(t *testing.T) {
+	defer func(d time.Duration, bs []botState, ps [][]cell) {
+		stateLock.Lock()
+		movTimeout, botStates, paths = d, bs, ps
+		stateLock.Unlock()
+	}(movTimeout, botStates, paths)
+	movTimeout = 10 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		answered botState // the state the bot's callback moves it on to, Idle for none
+		want     botState
+	}{
+		{name: "no callback", want: stateFailed},
+		{name: "answered", answered: stateMoving, want: stateMoving},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateLock.Lock()
+			botStates = []botState{stateRotating}
+			paths = [][]cell{{{1, 0}}}
+			startMovTimer(0, stateRotating)
+			if tt.answered != stateIdle {
+				botStates[0] = tt.answered
+			}
+			stateLock.Unlock()
+			time.Sleep(10 * movTimeout)
+			stateLock.Lock()
+			got, path := botStates[0], paths[0]
+			stopMovTimer(0)
+			stateLock.Unlock()
+			if got != tt.want {
+				t.Fatalf("after the timeout the bot is %v, want %v", got, tt.want)
+			}
+			if (got == stateFailed) != (path == nil) {
+				t.Fatalf("bot %v kept path %v", got, path)
+			}
+		})
+	}
+}
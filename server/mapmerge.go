@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// *** MAP MERGING ***
+
+// during an exploration the shared ogm is whatever it held before plus every
+// bot's own grid where it sits, and nothing else: each bot keeps a grid of
+// only its own readings in its own frame, anchored where it took its first
+// reading, and every reading goes into it (from the bot's pose as the
+// estimator has it) and, through its frame, into the ogm. Every so often
+// each grid is slid and turned against the others until its walls line up
+// best, and the ogm is rebuilt from the grids where they now sit: a bot
+// localized wrong to begin with gets pulled onto the others' walls (its
+// pose, trajectory and particles along with it) instead of smearing the map
+//  -- with no map from before, the lowest bot ID is the anchor and stays put
+//  -- a grid only moves when it matches at least mergeMinCells walls, and
+//     mergeGain more than where it is
+//  -- the search runs on a copy of the grids, without stateLock
+
+// gridFrame places a bot's grid in the global one: its cell c is global
+// cell rotate(c, R) + (X, Y)
+type gridFrame struct {
+	X int     `json:"x"`
+	Y int     `json:"y"`
+	R float64 `json:"r"` // degrees
+}
+
+var (
+	mergeEvery    time.Duration = 30 * time.Second // 0 only merges on POST /map/merge
+	mergeCells    int           = 5                // cells either way to slide a grid
+	mergeDeg      float64       = 10               // degrees either way to turn a grid
+	mergeDegStep  float64       = 2.5
+	mergeMinCells int           = 10
+	mergeGain     int           = 3
+
+	priorMap  = make(map[cell]float64)         // the ogm as the exploration found it
+	localMaps = make(map[int]map[cell]float64) // [botID] -> log-odds in its own frame
+	frames    = make(map[int]gridFrame)        // [botID] -> where its grid sits
+)
+
+func (f gridFrame) toGlobal(c cell) cell {
+	if f.R == 0 {
+		return cell{x: c.x + f.X, y: c.y + f.Y}
+	}
+	th := f.R * math.Pi / 180
+	x, y := float64(c.x), float64(c.y)
+	return cell{
+		x: int(math.Round(x*math.Cos(th)-y*math.Sin(th))) + f.X,
+		y: int(math.Round(x*math.Sin(th)+y*math.Cos(th))) + f.Y,
+	}
+}
+
+func (f gridFrame) toLocal(c cell) cell {
+	x, y := float64(c.x-f.X), float64(c.y-f.Y)
+	if f.R == 0 {
+		return cell{x: c.x - f.X, y: c.y - f.Y}
+	}
+	th := -f.R * math.Pi / 180
+	return cell{
+		x: int(math.Round(x*math.Cos(th) - y*math.Sin(th))),
+		y: int(math.Round(x*math.Sin(th) + y*math.Cos(th))),
+	}
+}
+
+// localPose is global pose p seen from the grid's frame
+func (f gridFrame) localPose(p pose) pose {
+	lx, ly := p.x-float64(f.X)*xscale, p.y-float64(f.Y)*yscale
+	th := -f.R * math.Pi / 180
+	return pose{
+		x: lx*math.Cos(th) - ly*math.Sin(th),
+		y: lx*math.Sin(th) + ly*math.Cos(th),
+		r: normalizeDeg(p.r - f.R),
+	}
+}
+
+// carry moves global pose p along with a grid going from frame f to nf
+func (f gridFrame) carry(nf gridFrame, p pose) pose {
+	lx, ly := p.x-float64(f.X)*xscale, p.y-float64(f.Y)*yscale
+	th := (nf.R - f.R) * math.Pi / 180
+	return pose{
+		x: lx*math.Cos(th) - ly*math.Sin(th) + float64(nf.X)*xscale,
+		y: lx*math.Sin(th) + ly*math.Cos(th) + float64(nf.Y)*yscale,
+		r: normalizeDeg(p.r + nf.R - f.R),
+	}
+}
+
+// resetLocalMaps starts every bot on an empty grid where it stands, on top
+// of the current ogm (caller must hold stateLock)
+func resetLocalMaps() {
+	priorMap = make(map[cell]float64)
+	for c, v := range ogm {
+		priorMap[c] = v
+	}
+	localMaps = make(map[int]map[cell]float64)
+	frames = make(map[int]gridFrame)
+}
+
+// localMapOf returns botID's grid, anchoring a new one at its cell the
+// first time (caller must hold stateLock)
+func localMapOf(botID int) map[cell]float64 {
+	if g, ok := localMaps[botID]; ok {
+		return g
+	}
+	c := binPose(pos[botID])
+	frames[botID] = gridFrame{X: c.x, Y: c.y}
+	localMaps[botID] = make(map[cell]float64)
+	return localMaps[botID]
+}
+
+// updateLocalMap puts ultrasonic reading z into botID's grid, from its pose
+// seen from the grid's frame, and the same change into the ogm where the
+// grid sits; it returns the ogm cells it changed (caller must hold
+// stateLock)
+func updateLocalMap(botID int, z float64) []cell {
+	g := localMapOf(botID)
+	f := frames[botID]
+	p := f.localPose(pos[botID])
+	th := p.r * math.Pi / 180
+	e := pose{x: p.x + z*math.Cos(th), y: p.y + z*math.Sin(th)}
+	delta := make(map[cell]float64)
+	updateGrid(delta, binPose(p), binPose(e))
+	seen := make(map[cell]bool)
+	touched := []cell{}
+	for c, v := range delta {
+		g[c] += v
+		gc := f.toGlobal(c)
+		ogm[gc] += v
+		if !seen[gc] {
+			seen[gc] = true
+			touched = append(touched, gc)
+		}
+	}
+	return touched
+}
+
+// gridSet is the prior map and every grid where it sits
+type gridSet struct {
+	prior  map[cell]float64
+	grids  map[int]map[cell]float64
+	frames map[int]gridFrame
+}
+
+// liveGrids are the grids themselves (caller must hold stateLock)
+func liveGrids() gridSet {
+	return gridSet{prior: priorMap, grids: localMaps, frames: frames}
+}
+
+// copyGrids copies the grids, to align them without stateLock (caller
+// must hold stateLock)
+func copyGrids() gridSet {
+	gs := gridSet{
+		prior:  make(map[cell]float64, len(priorMap)),
+		grids:  make(map[int]map[cell]float64, len(localMaps)),
+		frames: make(map[int]gridFrame, len(frames)),
+	}
+	for c, v := range priorMap {
+		gs.prior[c] = v
+	}
+	for id, g := range localMaps {
+		cp := make(map[cell]float64, len(g))
+		for c, v := range g {
+			cp[c] = v
+		}
+		gs.grids[id] = cp
+		gs.frames[id] = frames[id]
+	}
+	return gs
+}
+
+// compose is the prior map plus every grid but skip's, where they sit
+func (gs gridSet) compose(skip int) map[cell]float64 {
+	m := make(map[cell]float64)
+	for c, v := range gs.prior {
+		m[c] = v
+	}
+	for id, g := range gs.grids {
+		if id == skip {
+			continue
+		}
+		f := gs.frames[id]
+		for c, v := range g {
+			m[f.toGlobal(c)] += v
+		}
+	}
+	return m
+}
+
+// mapChanges lists the cells of nm that differ from m, those nm dropped
+// at 0, as an ogm event has them
+func mapChanges(m, nm map[cell]float64) []cellValue {
+	cvs := []cellValue{}
+	for c, v := range nm {
+		if ov, ok := m[c]; !ok || ov != v {
+			cvs = append(cvs, cellValue{X: c.x, Y: c.y, L: v})
+		}
+	}
+	for c := range m {
+		if _, ok := nm[c]; !ok {
+			cvs = append(cvs, cellValue{X: c.x, Y: c.y, L: 0})
+		}
+	}
+	return cvs
+}
+
+// matchScore counts the walls of g that land on walls of m from frame f,
+// less those that land on free space and the free space of g that lands on
+// walls; a single echo is evidence enough
+func matchScore(g, m map[cell]float64, f gridFrame) (score, hits int) {
+	for c, v := range g {
+		if math.Abs(v) < knownThresh {
+			continue
+		}
+		t := m[f.toGlobal(c)]
+		switch {
+		case v > 0 && t >= knownThresh:
+			score++
+			hits++
+		case v > 0 && t <= -knownThresh, v < 0 && t >= knownThresh:
+			score--
+		}
+	}
+	return score, hits
+}
+
+// alignMap searches around frame cur for the one grid g fits map m best in
+func alignMap(g map[cell]float64, cur gridFrame, m map[cell]float64) (gridFrame, bool) {
+	best, _ := matchScore(g, m, cur)
+	bestFrame, moved := cur, false
+	for dr := -mergeDeg; dr <= mergeDeg; dr += mergeDegStep {
+		for dx := -mergeCells; dx <= mergeCells; dx++ {
+			for dy := -mergeCells; dy <= mergeCells; dy++ {
+				f := gridFrame{X: cur.X + dx, Y: cur.Y + dy, R: cur.R + dr}
+				score, hits := matchScore(g, m, f)
+				if hits >= mergeMinCells && score >= best+mergeGain {
+					best, bestFrame, moved = score, f, true
+				}
+			}
+		}
+	}
+	return bestFrame, moved
+}
+
+// frame json
+type botFrame struct {
+	ID    int       `json:"id"`
+	Frame gridFrame `json:"frame"`
+	Cells int       `json:"cells"` // known cells in its grid
+	Moved bool      `json:"moved"`
+}
+
+// mergeMaps aligns every grid against the rest of the map, carries the
+// bots whose grid moved along with it and rebuilds the ogm; it takes
+// stateLock itself, and not while searching
+func mergeMaps() []botFrame {
+	stateLock.RLock()
+	gs := copyGrids()
+	numBots := len(pos)
+	stateLock.RUnlock()
+	anchor := -1
+	if len(gs.prior) == 0 {
+		for id := range gs.grids {
+			if anchor == -1 || id < anchor {
+				anchor = id
+			}
+		}
+	}
+	// later grids align against the earlier ones where they moved to
+	was := make(map[int]gridFrame)
+	for id := 0; id < numBots; id++ {
+		g, ok := gs.grids[id]
+		if !ok || id == anchor {
+			continue
+		}
+		if f, moved := alignMap(g, gs.frames[id], gs.compose(id)); moved {
+			was[id] = gs.frames[id]
+			gs.frames[id] = f
+		}
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	bfs := []botFrame{}
+	changed := false
+	for id := 0; id < len(pos); id++ {
+		g, ok := localMaps[id]
+		if !ok {
+			continue
+		}
+		bf := botFrame{ID: id, Frame: frames[id], Cells: len(g)}
+		// a grid started over while searching stays where it is
+		if f0, ok := was[id]; ok && frames[id] == f0 {
+			f := gs.frames[id]
+			carryBot(id, f0, f)
+			frames[id] = f
+			bf.Frame, bf.Moved = f, true
+			changed = true
+			fmt.Printf("  bot %v: grid moved to %+v.\n", id, f)
+			publishFix(id, "merge")
+		}
+		bfs = append(bfs, bf)
+	}
+	if changed {
+		old := ogm
+		ogm = liveGrids().compose(-1)
+		publish(evOGM, -1, mapChanges(old, ogm))
+	}
+	return bfs
+}
+
+// carryBot moves botID's pose, trajectory and particles with its grid
+// going from frame f to nf (caller must hold stateLock)
+func carryBot(botID int, f, nf gridFrame) {
+	pos[botID] = f.carry(nf, pos[botID])
+	if botID < len(traj) {
+		for i, p := range traj[botID] {
+			traj[botID][i] = f.carry(nf, p)
+		}
+	}
+	if pf, ok := filters[botID]; ok {
+		for i := range pf.ps {
+			pf.ps[i].p = f.carry(nf, pf.ps[i].p)
+		}
+	}
+	// the position covariance turns with the grid
+	th := (nf.R - f.R) * math.Pi / 180
+	if th == 0 {
+		return
+	}
+	P := poseCovs[botID]
+	R := [3][3]float64{{math.Cos(th), -math.Sin(th), 0}, {math.Sin(th), math.Cos(th), 0}, {0, 0, 1}}
+	next := covariance{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					next[i][j] += R[i][a] * P[a][b] * R[j][b]
+				}
+			}
+		}
+	}
+	poseCovs[botID] = next
+}
+
+// maybeMerge merges the grids every mergeEvery (runs on the dispatch loop)
+func (run *exploration) maybeMerge() {
+	if mergeEvery <= 0 || time.Since(run.merged) < mergeEvery {
+		return
+	}
+	run.merged = time.Now()
+	mergeMaps()
+}
+
+// writeMerge merges the grids now and replies with where they sit as json
+func writeMerge(w http.ResponseWriter) {
+	bfs := mergeMaps()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bfs)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+// corner is a room corner: walls along x and y from the origin, free space
+// between them
+func corner(m map[cell]float64) {
+	for i := 0; i <= 20; i++ {
+		m[cell{x: i, y: 0}] = 2 * occThresh
+		m[cell{x: 0, y: i}] = 2 * occThresh
+	}
+	knownFree(m, cell{1, 1}, cell{8, 8})
+}
+
+func TestAlignMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		truth     gridFrame // where the grid really sits
+		cur       gridFrame // where it is thought to sit
+		walls     int       // how much of the corner the grid saw, 0 for all of it
+		want      gridFrame
+		wantMoved bool
+	}{
+		{name: "in place", want: gridFrame{}},
+		{name: "slid", truth: gridFrame{X: 3, Y: -2}, want: gridFrame{X: 3, Y: -2}, wantMoved: true},
+		{name: "slid back", truth: gridFrame{X: -1, Y: 4}, cur: gridFrame{X: 2, Y: 2}, want: gridFrame{X: -1, Y: 4}, wantMoved: true},
+		{name: "turned", truth: gridFrame{X: 1, Y: 1, R: 5}, want: gridFrame{X: 1, Y: 1, R: 5}, wantMoved: true},
+		{name: "out of reach", truth: gridFrame{X: 30}, want: gridFrame{}},
+		{name: "too few walls to go by", truth: gridFrame{X: 3}, walls: 4, want: gridFrame{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := make(map[cell]float64)
+			corner(m)
+			// the grid is the corner as seen from its true frame
+			g := make(map[cell]float64)
+			for c, v := range m {
+				if v > 0 && tt.walls > 0 && (c.x > tt.walls || c.y > 0) {
+					continue
+				}
+				if v < 0 && tt.walls > 0 {
+					continue
+				}
+				g[tt.truth.toLocal(c)] = v
+			}
+			got, moved := alignMap(g, tt.cur, m)
+			if got != tt.want || moved != tt.wantMoved {
+				t.Fatalf("alignMap = %+v, %v; want %+v, %v", got, moved, tt.want, tt.wantMoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// *** MONTE CARLO LOCALIZATION ***
+
+// each bot carries a cloud of pose hypotheses: every /mov callback moves
+// them all with sampled odometry noise, every ultrasonic reading weighs them
+// by how well the ogm explains it from there, and the
+// cloud is resampled by weight; pos[] is then the cloud's mean and the pose
+// covariance its spread
+//  -- readings are skipped when most particles find no wall near them yet
+//  -- readings no particle can explain, kidnapMisses times in a row (a
+//     kidnapped bot, or a diverged estimate), scatter the whole cloud over
+//     the known free space; so does POST /relocalize
+
+type particle struct {
+	p pose
+	w float64
+}
+
+var (
+	numParticles int     = 300
+	ultSigma     float64 = 10  // cm, ultrasonic reading noise
+	ultMax       float64 = 500 // cm, farthest the ultrasonic reads
+	ultHit       float64 = 0.9 // share of readings that are the wall, the rest are junk
+	fieldCells   int     = 3   // how far around a reading's end to look for a wall
+	kidnapMisses int     = 3
+
+	filters = make(map[int]*particleFilter) // [botID] -> particles, made on first use
+)
+
+type particleFilter struct {
+	ps     []particle
+	misses int  // readings in a row that no particle explained
+	global bool // scattered by relocalize and not yet converged
+}
+
+// gauss samples a normal distribution
+func gauss(sigma float64) float64 {
+	return rand.NormFloat64() * sigma
+}
+
+// filterOf returns botID's particles, spreading new ones over the pose
+// covariance the first time (caller must hold stateLock)
+func filterOf(botID int) *particleFilter {
+	if pf, ok := filters[botID]; ok {
+		return pf
+	}
+	P := poseCovs[botID]
+	sx, sy, sr := math.Sqrt(P[0][0]), math.Sqrt(P[1][1]), math.Sqrt(P[2][2])
+	pf := &particleFilter{ps: make([]particle, numParticles)}
+	for i := range pf.ps {
+		p := pos[botID]
+		pf.ps[i] = particle{
+			p: pose{x: p.x + gauss(sx), y: p.y + gauss(sy), r: normalizeDeg(p.r + gauss(sr))},
+			w: 1 / float64(numParticles),
+		}
+	}
+	filters[botID] = pf
+	return pf
+}
+
+// mclPredict moves botID's particles like applyMotion moves its pose,
+// sampling the odometry noise (caller must hold stateLock)
+func mclPredict(botID int, rot, d float64) {
+	mn := noiseOf(botID)
+	pf := filterOf(botID)
+	for i := range pf.ps {
+		p := &pf.ps[i].p
+		if rot != 0 {
+			p.r = normalizeDeg(p.r + rot + gauss(mn.RotPer*math.Abs(rot)+mn.RotBase))
+		}
+		if d != 0 {
+			dd := d + gauss(mn.FwdPer*math.Abs(d)+mn.FwdBase)
+			th := p.r * math.Pi / 180
+			p.x += dd * math.Cos(th)
+			p.y += dd * math.Sin(th)
+			p.r = normalizeDeg(p.r + gauss(mn.DriftPer*math.Abs(d)))
+		}
+	}
+}
+
+// rayCast scores reading z from p against the ogm: the beam is walked
+// cell by cell, a wall it passes through means the reading should have
+// been that short, otherwise the reading is scored by how far its end
+// lands from a cell with evidence of a wall; false when the map has no
+// opinion (the end is in unknown space with no wall nearby)
+func rayCast(p pose, z float64) (float64, bool) {
+	th := p.r * math.Pi / 180
+	step := math.Min(xscale, yscale) / 2
+	end := math.Min(z, ultMax)
+	for t := 0.0; t < end-2*ultSigma; t += step {
+		c := binPose(pose{x: p.x + t*math.Cos(th), y: p.y + t*math.Sin(th)})
+		if ogm[c] >= occThresh {
+			return readingLikelihood(z, t), true
+		}
+	}
+	if z >= ultMax {
+		return readingLikelihood(z, ultMax), true
+	}
+	e := pose{x: p.x + z*math.Cos(th), y: p.y + z*math.Sin(th)}
+	ec := binPose(e)
+	best := math.Inf(1)
+	for i := -fieldCells; i <= fieldCells; i++ {
+		for j := -fieldCells; j <= fieldCells; j++ {
+			c := cell{x: ec.x + i, y: ec.y + j}
+			if ogm[c] < knownThresh {
+				continue
+			}
+			dist := math.Hypot(float64(i)*xscale, float64(j)*yscale)
+			best = math.Min(best, dist)
+		}
+	}
+	if math.IsInf(best, 1) {
+		if isUnknown(ec) {
+			return 0, false
+		}
+		best = float64(fieldCells+1) * math.Min(xscale, yscale)
+	}
+	return readingLikelihood(z, z-best), true
+}
+
+// readingLikelihood is p(reading z | expected distance)
+func readingLikelihood(z, expected float64) float64 {
+	junk := (1 - ultHit) / ultMax
+	if z >= ultMax {
+		// nothing in range, fine as long as nothing was expected
+		if expected >= ultMax-2*ultSigma {
+			return ultHit + junk
+		}
+		return junk
+	}
+	e := (z - expected) / ultSigma
+	return ultHit*math.Exp(-e*e/2)/(ultSigma*math.Sqrt(2*math.Pi)) + junk
+}
+
+// mclUpdate weighs botID's particles by ultrasonic reading z, resamples
+// them and moves pos[botID] to the result (caller must hold stateLock)
+func mclUpdate(botID int, z float64) {
+	pf := filterOf(botID)
+	weights := make([]float64, len(pf.ps))
+	seen := make([]bool, len(pf.ps))
+	informative, total, best := 0, 0.0, 0.0
+	for i, pt := range pf.ps {
+		l, ok := rayCast(pt.p, z)
+		if !ok {
+			continue
+		}
+		weights[i] = pt.w * l
+		seen[i] = true
+		informative++
+		total += weights[i]
+		best = math.Max(best, l)
+	}
+	if informative < len(pf.ps)/2 {
+		// the map around the bot is too thin to tell particles apart
+		return
+	}
+	if best < readingLikelihood(z, z-3*ultSigma) {
+		pf.misses++
+		fmt.Printf("  bot %v: no particle explains the reading %v cm (%v in a row).\n", botID, z, pf.misses)
+		if pf.misses >= kidnapMisses && !pf.global {
+			if err := mclRelocalize(botID); err != nil {
+				fmt.Printf("  bot %v: %v\n", botID, err)
+			}
+		}
+		return
+	}
+	pf.misses = 0
+	// particles whose rays see unknown space have no opinion, weigh them
+	// like the average one that does
+	mean := total / float64(informative)
+	for i := range weights {
+		if !seen[i] {
+			weights[i] = mean
+			total += mean
+		}
+	}
+	resample(pf, weights, total)
+	estimate(botID, pf)
+}
+
+// mclRange weighs botID's particles by range z to a bot at other (with
+// covariance otherP), resamples them and moves pos[botID] to the result
+// (caller must hold stateLock)
+func mclRange(botID int, other pose, otherP covariance, z float64) error {
+	rf, err := fitRange(botID, other, otherP, z)
+	if err != nil {
+		return err
+	}
+	pf := filterOf(botID)
+	s2 := rf.otherVar + rangeSigma*rangeSigma
+	weights := make([]float64, len(pf.ps))
+	total := 0.0
+	for i, pt := range pf.ps {
+		e := math.Hypot(pt.p.x-other.x, pt.p.y-other.y) - z
+		weights[i] = pt.w * math.Exp(-e*e/(2*s2))
+		total += weights[i]
+	}
+	if total == 0 {
+		return fmt.Errorf("no particle explains range %.1f cm", z)
+	}
+	resample(pf, weights, total)
+	estimate(botID, pf)
+	return nil
+}
+
+// resample redraws pf's particles in proportion to weights (summing to
+// total), low-variance style
+func resample(pf *particleFilter, weights []float64, total float64) {
+	n := len(pf.ps)
+	next := make([]particle, 0, n)
+	step := total / float64(n)
+	u := rand.Float64() * step
+	acc, j := weights[0], 0
+	for i := 0; i < n; i++ {
+		target := u + float64(i)*step
+		for acc < target && j < n-1 {
+			j++
+			acc += weights[j]
+		}
+		next = append(next, particle{p: pf.ps[j].p, w: 1 / float64(n)})
+	}
+	pf.ps = next
+}
+
+// estimate sets pos[botID] and its covariance from the particles
+// (caller must hold stateLock)
+func estimate(botID int, pf *particleFilter) {
+	n := float64(len(pf.ps))
+	mx, my, sin, cos := 0.0, 0.0, 0.0, 0.0
+	for _, pt := range pf.ps {
+		mx += pt.p.x / n
+		my += pt.p.y / n
+		sin += math.Sin(pt.p.r * math.Pi / 180)
+		cos += math.Cos(pt.p.r * math.Pi / 180)
+	}
+	mr := normalizeDeg(math.Atan2(sin, cos) * 180 / math.Pi)
+	P := covariance{}
+	for _, pt := range pf.ps {
+		dv := [3]float64{pt.p.x - mx, pt.p.y - my, normalizeDeg(pt.p.r-mr+180) - 180}
+		for a := 0; a < 3; a++ {
+			for b := 0; b < 3; b++ {
+				P[a][b] += dv[a] * dv[b] / n
+			}
+		}
+	}
+	pos[botID] = pose{x: mx, y: my, r: mr}
+	poseCovs[botID] = P
+	if pf.global && positionSigma(botID) < relocSigma/2 {
+		pf.global = false
+		fmt.Printf("  bot %v: relocalized at %v.\n", botID, pos[botID])
+		publishFix(botID, "mcl")
+	}
+}
+
+// knownFreeCells lists the cells known to be free
+func knownFreeCells() []cell {
+	free := []cell{}
+	for c := range ogm {
+		if isFree(c) {
+			free = append(free, c)
+		}
+	}
+	return free
+}
+
+// randomFreePose is a uniformly random pose inside one of the free cells
+func randomFreePose(free []cell) pose {
+	c := free[rand.Intn(len(free))]
+	// binPose truncates toward zero, so negative cells extend the other way
+	within := func(i int) float64 {
+		if i < 0 {
+			return float64(i) - rand.Float64()
+		}
+		return float64(i) + rand.Float64()
+	}
+	return pose{x: within(c.x) * xscale, y: within(c.y) * yscale, r: rand.Float64() * 360}
+}
+
+// mclRelocalize scatters botID's particles over all the known free space,
+// the readings that follow pull them back together (caller must hold
+// stateLock)
+func mclRelocalize(botID int) error {
+	pf := filterOf(botID)
+	free := knownFreeCells()
+	if len(free) == 0 {
+		return fmt.Errorf("no known free space to relocalize bot %v in", botID)
+	}
+	for i := range pf.ps {
+		pf.ps[i] = particle{p: randomFreePose(free), w: 1 / float64(len(pf.ps))}
+	}
+	pf.misses = 0
+	pf.global = true
+	fmt.Printf("  bot %v: global relocalization over %v free cells.\n", botID, len(free))
+	estimate(botID, pf)
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// *** ODOMETRY MOTION MODEL ***
+
+// every /mov callback moves a bot's pose by the rotation and distance it
+// reports, and grows the pose covariance by how much those reports can be
+// trusted: the gyro drifts with the angle turned, the ultrasonic distance
+// with the distance driven, and driving straight still twists the heading
+
+// covariance of (x cm, y cm, r degrees)
+type covariance [3][3]float64
+
+// motionNoise is one bot's odometry error, each standard deviation being
+// per*|amount| + base
+type motionNoise struct {
+	RotPer   float64 `json:"rot"`     // degrees of heading error per degree turned
+	RotBase  float64 `json:"rotbase"` // degrees of heading error per turn
+	FwdPer   float64 `json:"fwd"`     // cm of distance error per cm driven
+	FwdBase  float64 `json:"fwdbase"` // cm of distance error per move
+	DriftPer float64 `json:"drift"`   // degrees of heading error per cm driven
+}
+
+var (
+	defaultNoise         = motionNoise{RotPer: 0.05, RotBase: 2, FwdPer: 0.05, FwdBase: 1, DriftPer: 0.05}
+	relocSigma   float64 = 30 // cm, position uncertainty that calls for relocalization
+
+	noises   = make(map[int]motionNoise) // [botID] -> calibrated noise, defaultNoise if missing
+	poseCovs = make(map[int]covariance)  // [botID] -> pose covariance, zero if missing
+	lost     = make(map[int]bool)        // [botID] -> relocalization failed, until it is sure again
+)
+
+func noiseOf(botID int) motionNoise {
+	if mn, ok := noises[botID]; ok {
+		return mn
+	}
+	return defaultNoise
+}
+
+// normalizeDeg wraps degrees into [0, 360)
+func normalizeDeg(r float64) float64 {
+	r = math.Mod(r, 360)
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
+
+// applyMotion turns botID by rot degrees, then drives it d cm along its
+// new heading (caller must hold stateLock)
+func applyMotion(botID int, rot, d float64) {
+	mn := noiseOf(botID)
+	p := pos[botID]
+	P := poseCovs[botID]
+	if rot != 0 {
+		sr := mn.RotPer*math.Abs(rot) + mn.RotBase
+		p.r = normalizeDeg(p.r + rot)
+		P[2][2] += sr * sr
+	}
+	if d != 0 {
+		th := p.r * math.Pi / 180 // sin/cos input radians
+		p.x += d * math.Cos(th)
+		p.y += d * math.Sin(th)
+		// linearize around the heading: G is d(pose')/d(pose), V is
+		// d(pose')/d(distance, drift)
+		k := math.Pi / 180 // heading is in degrees
+		G := [3][3]float64{
+			{1, 0, -d * math.Sin(th) * k},
+			{0, 1, d * math.Cos(th) * k},
+			{0, 0, 1},
+		}
+		sd := mn.FwdPer*math.Abs(d) + mn.FwdBase
+		sdrift := mn.DriftPer * math.Abs(d)
+		V := [3][2]float64{
+			{math.Cos(th), 0},
+			{math.Sin(th), 0},
+			{0, 1},
+		}
+		M := [2]float64{sd * sd, sdrift * sdrift}
+		next := covariance{}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				for a := 0; a < 3; a++ {
+					for b := 0; b < 3; b++ {
+						next[i][j] += G[i][a] * P[a][b] * G[j][b]
+					}
+				}
+				for a := 0; a < 2; a++ {
+					next[i][j] += V[i][a] * M[a] * V[j][a]
+				}
+			}
+		}
+		P = next
+	}
+	pos[botID] = p
+	poseCovs[botID] = P
+}
+
+// setPoseCov replaces botID's covariance, eg after a localization fix
+// (caller must hold stateLock)
+func setPoseCov(botID int, sxy, sr float64) {
+	poseCovs[botID] = covariance{{sxy * sxy, 0, 0}, {0, sxy * sxy, 0}, {0, 0, sr * sr}}
+}
+
+// positionSigma is the standard deviation of botID's position, in cm
+func positionSigma(botID int) float64 {
+	P := poseCovs[botID]
+	return math.Sqrt(P[0][0] + P[1][1])
+}
+
+// needsRelocalization reports whether botID has drifted too far to trust
+// its pose
+func needsRelocalization(botID int) bool {
+	return positionSigma(botID) > relocSigma
+}
+
+// relocalizers are tried in order by relocalize, the first to fix the pose
+// wins; each returns false when it could not (caller must hold stateLock)
+var relocalizers = []func(botID int) bool{estimatorRelocalize, acousticRelocalize}
+
+// estimatorRelocalize has the estimator start finding botID again, once
+// per time it gets lost; it finds it over the next moves, never right away
+// (caller must hold stateLock)
+func estimatorRelocalize(botID int) bool {
+	if lost[botID] {
+		return false
+	}
+	if err := activeEstimator.Relocalize(botID); err != nil {
+		fmt.Printf("  bot %v: %v\n", botID, err)
+	}
+	return false
+}
+
+// relocalize tries to pin botID's pose down again (caller must hold
+// stateLock)
+func relocalize(botID int) bool {
+	if !lost[botID] {
+		fmt.Printf("  bot %v: pose uncertainty %.1f cm over %v cm, relocalizing.\n", botID, positionSigma(botID), relocSigma)
+	}
+	for _, reloc := range relocalizers {
+		if reloc(botID) {
+			delete(lost, botID)
+			return true
+		}
+	}
+	if !lost[botID] {
+		fmt.Printf("  bot %v: could not relocalize.\n", botID)
+	}
+	lost[botID] = true
+	return false
+}
+
+// checkUncertainty relocalizes botID if it needs it (caller must hold
+// stateLock)
+func checkUncertainty(botID int) {
+	if !needsRelocalization(botID) {
+		delete(lost, botID)
+		return
+	}
+	relocalize(botID)
+}
+
+// uncertainty json
+type botUncertainty struct {
+	ID         int         `json:"id"`
+	Pose       pose        `json:"pose"`
+	Cov        covariance  `json:"cov"`
+	SigmaXY    float64     `json:"sigmaxy"` // cm
+	SigmaR     float64     `json:"sigmar"`  // degrees
+	Relocalize bool        `json:"relocalize"`
+	Noise      motionNoise `json:"noise"`
+}
+
+// uncertaintyOf describes botID's pose uncertainty (caller must hold
+// stateLock)
+func uncertaintyOf(botID int) botUncertainty {
+	return botUncertainty{
+		ID:         botID,
+		Pose:       pos[botID],
+		Cov:        poseCovs[botID],
+		SigmaXY:    positionSigma(botID),
+		SigmaR:     math.Sqrt(poseCovs[botID][2][2]),
+		Relocalize: needsRelocalization(botID),
+		Noise:      noiseOf(botID),
+	}
+}
+
+// writeUncertainty replies with every bot's pose uncertainty as json
+func writeUncertainty(w http.ResponseWriter) {
+	stateLock.RLock()
+	us := []botUncertainty{}
+	for id := range bot {
+		if id >= len(pos) {
+			break
+		}
+		us = append(us, uncertaintyOf(id))
+	}
+	stateLock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(us)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// *** SPEAKER ONSET ***
+
+// a bot told to speak at t reports t as its start, but the tone only leaves
+// the speaker some ms later, and every one of those ms reads as 3.4 cm more
+// between the bots. POST /bots/{id}/onset measures it: the bot is placed a
+// known distance from a listener and speaks to it onsetRounds times, and
+// whatever the range comes out over the distance, as time of flight, is the
+// bot's onset. localize and acousticRange add it to the speaker's start
+// when they find the tone in the recording (speakerIndex)
+//  -- the listener's own lag folds into it, so calibrate against the bot
+//     that usually listens (0 for localize)
+//  -- the median is kept, a bad correlation is as likely as not to be one
+//     of the rounds
+
+// onset request json
+type onsetPostData struct {
+	Listener *int     `json:"listener"`
+	Distance *float64 `json:"distance"` // cm between the bots' centers
+	Rounds   *int     `json:"rounds"`
+}
+
+var (
+	onsetRounds int     = 5
+	onsetMax    float64 = 250  // ms, past this the tone misses the recording
+	soundSpeed  float64 = 34.3 // cm per ms, as in xcorr
+)
+
+func (req onsetPostData) check(speaker, numBots int) error {
+	if req.Listener == nil {
+		return fmt.Errorf("listener is missing")
+	}
+	if l := *req.Listener; l < 0 || l >= numBots || l == speaker {
+		return fmt.Errorf("listener %v is not another registered bot (%v registered)", l, numBots)
+	}
+	if req.Distance == nil {
+		return fmt.Errorf("distance is missing")
+	}
+	if d := *req.Distance; d <= 0 || d > rangeMax {
+		return fmt.Errorf("distance %v is not between 0 and %v cm", d, rangeMax)
+	}
+	if req.Rounds != nil && (*req.Rounds < 1 || *req.Rounds > calMaxRounds) {
+		return fmt.Errorf("rounds %v is not between 1 and %v", *req.Rounds, calMaxRounds)
+	}
+	return nil
+}
+
+// speakerIndex is the sample of lpd's recording at which the tone of spd
+// reaches it, by the bots' clock offsets and onsetMs of the speaker's
+// (caller must hold stateLock, or be localize)
+func speakerIndex(lpd, spd *locPostData, listener, speaker int, onsetMs float64) int {
+	onset := int64(math.Round(onsetMs))
+	dt := (spd.Start + onset + clocks[speaker]) - (lpd.Start + clocks[listener])
+	// samples per ms is rarely a whole number
+	return int(float64(dt) * float64(len(lpd.left)) / float64(lpd.Total))
+}
+
+// calibrateOnset has speaker speak to listener distance cm away, rounds
+// times, and fits the speaker's onset
+func calibrateOnset(speaker, listener int, distance float64, rounds int) (calibration, error) {
+	cal := calibrationOf(speaker)
+	cal.Samples = nil
+	onsets := []float64{}
+	// no range may go off between the rounds
+	acousticLock.Lock()
+	defer acousticLock.Unlock()
+	for i := 0; i < rounds; i++ {
+		spd, lpd, _, err := listenAndSpeakLocked(rangeDelay, listener, speaker)
+		if err != nil {
+			return cal, err
+		}
+		lpd.formatSamples()
+		if len(lpd.left) == 0 || lpd.Total == 0 {
+			fmt.Printf("  bot %v: recorded no samples, skipped.\n", listener)
+			continue
+		}
+		stateLock.RLock()
+		lpd.sOffset = speakerIndex(lpd, spd, listener, speaker, 0)
+		stateLock.RUnlock()
+		d := (xcorr(tone, lpd.left, lpd.sOffset) + xcorr(tone, lpd.right, lpd.sOffset)) / 2
+		ms := (d - distance) / soundSpeed
+		if math.IsNaN(ms) || math.Abs(ms) > onsetMax {
+			fmt.Printf("  bot %v: ranged %.1f cm for %.1f, skipped.\n", speaker, d, distance)
+			continue
+		}
+		cal.Samples = append(cal.Samples, calSample{Kind: "onset", Cmd: distance, Actual: d})
+		onsets = append(onsets, ms)
+	}
+	if len(onsets) < (rounds+1)/2 {
+		return cal, fmt.Errorf("onset: %v good rounds out of %v, is bot %v %v cm from bot %v?", len(onsets), rounds, speaker, distance, listener)
+	}
+	sort.Float64s(onsets)
+	cal.OnsetMs = onsets[len(onsets)/2]
+	if len(onsets)%2 == 0 {
+		cal.OnsetMs = (onsets[len(onsets)/2-1] + onsets[len(onsets)/2]) / 2
+	}
+	cal.Time = makeTimestamp()
+	setCalibration(speaker, cal)
+	return cal, nil
+}
+
+// handleOnset serves POST /bots/{id}/onset
+func handleOnset(w http.ResponseWriter, r *http.Request, botID int) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "%v not allowed, only POST", r.Method)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	stateLock.RLock()
+	numBots := len(bot)
+	stateLock.RUnlock()
+	if botID < 0 || botID >= numBots {
+		writeError(w, http.StatusNotFound, "no bot %v (%v registered)", botID, numBots)
+		return
+	}
+	req := onsetPostData{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := req.check(botID, numBots); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	rounds := onsetRounds
+	if req.Rounds != nil {
+		rounds = *req.Rounds
+	}
+	diagLock.Lock()
+	defer diagLock.Unlock()
+	// the bots have to stay put at the distance
+	if _, err := runByID(0); err == nil {
+		writeError(w, http.StatusConflict, "an exploration is running, stop it first")
+		return
+	}
+	fmt.Printf("  bot %v: timing speaker onset against bot %v.\n", botID, *req.Listener)
+	d := diagnostic{Time: makeTimestamp(), Bot: botID, Check: "onset", Request: strings.TrimSpace(string(body))}
+	start := time.Now()
+	cal, err := calibrateOnset(botID, *req.Listener, *req.Distance, rounds)
+	d.Millis = time.Since(start).Milliseconds()
+	d.OK = err == nil
+	d.Reply = fmt.Sprintf("onset %.1f ms against bot %v at %v cm", cal.OnsetMs, *req.Listener, *req.Distance)
+	status := http.StatusOK
+	if err != nil {
+		d.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	recordDiagnostic(d)
+	writeJSON(w, status, calibrateResult{calibration: cal, Error: d.Error})
+}
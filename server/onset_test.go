@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestSpeakerIndex(t *testing.T) {
+	defer func(c []int64) { clocks = c }(clocks)
+	tests := []struct {
+		name    string
+		clocks  []int64
+		lStart  int64
+		sStart  int64
+		samples int   // recorded by the listener
+		total   int64 // ms they span
+		onsetMs float64
+		want    int
+	}{
+		{name: "whole samples per ms", clocks: []int64{0, 0}, lStart: 50, sStart: 100, samples: 1000, total: 500, want: 100},
+		{name: "fractional samples per ms", clocks: []int64{0, 0}, lStart: 50, sStart: 100, samples: 750, total: 500, want: 75},
+		{name: "under one sample per ms", clocks: []int64{0, 0}, lStart: 0, sStart: 100, samples: 250, total: 500, want: 50},
+		{name: "onset rounded", clocks: []int64{0, 0}, lStart: 50, sStart: 100, samples: 750, total: 500, onsetMs: 10.4, want: 90},
+		{name: "clock offsets", clocks: []int64{1000, 1030}, lStart: 50, sStart: 40, samples: 1000, total: 500, want: 40},
+		{name: "speaker first", clocks: []int64{0, 0}, lStart: 100, sStart: 80, samples: 1000, total: 500, want: -40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clocks = tt.clocks
+			lpd := &locPostData{Start: tt.lStart, Total: tt.total, left: make([]float64, tt.samples)}
+			spd := &locPostData{Start: tt.sStart}
+			if got := speakerIndex(lpd, spd, 0, 1, tt.onsetMs); got != tt.want {
+				t.Fatalf("speakerIndex = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
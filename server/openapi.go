@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// *** OPENAPI ***
+
+// openapi.json describes every endpoint, the operator's and the ones the
+// bots call back on. It is served at GET /openapi.json, and every request
+// is checked against it before it reaches a handler: a malformed one is
+// answered 400 (405 for a method the path does not take) with a json error
+//  -- only the parts of json schema the document uses are understood
+//  -- a body is checked as json when the operation takes json and it
+//     parses, as text otherwise; the bots and curl rarely set Content-Type
+//  -- paths the document does not know go straight to the router
+
+//go:embed openapi.json
+var openapiJSON []byte
+
+var maxBody int64 = 4 << 20 // bytes, a listener's samples are well under
+
+type oaSchema struct {
+	Ref                  string               `json:"$ref"`
+	Type                 string               `json:"type"`
+	Properties           map[string]*oaSchema `json:"properties"`
+	Required             []string             `json:"required"`
+	AdditionalProperties json.RawMessage      `json:"additionalProperties"` // false or a schema
+	Items                *oaSchema            `json:"items"`
+	Minimum              *float64             `json:"minimum"`
+	Maximum              *float64             `json:"maximum"`
+	Enum                 []interface{}        `json:"enum"`
+	Pattern              string               `json:"pattern"`
+	OneOf                []*oaSchema          `json:"oneOf"`
+
+	closed bool      // additionalProperties: false
+	extra  *oaSchema // additionalProperties as a schema
+	re     *regexp.Regexp
+}
+
+type oaParameter struct {
+	Name     string    `json:"name"`
+	In       string    `json:"in"` // path or query
+	Required bool      `json:"required"`
+	Schema   *oaSchema `json:"schema"`
+}
+
+type oaMedia struct {
+	Schema *oaSchema `json:"schema"`
+}
+
+type oaRequestBody struct {
+	Required bool               `json:"required"`
+	Content  map[string]oaMedia `json:"content"`
+}
+
+type oaOperation struct {
+	Parameters  []oaParameter  `json:"parameters"`
+	RequestBody *oaRequestBody `json:"requestBody"`
+}
+
+type oaSpec struct {
+	Paths      map[string]map[string]*oaOperation `json:"paths"` // [path][method]
+	Components struct {
+		Schemas map[string]*oaSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+// loadSpec parses the document and compiles its schemas
+func loadSpec(b []byte) (*oaSpec, error) {
+	spec := &oaSpec{}
+	if err := json.Unmarshal(b, spec); err != nil {
+		return nil, err
+	}
+	for name, s := range spec.Components.Schemas {
+		if err := spec.compile(s); err != nil {
+			return nil, fmt.Errorf("schema %v: %v", name, err)
+		}
+	}
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			for _, p := range op.Parameters {
+				if err := spec.compile(p.Schema); err != nil {
+					return nil, fmt.Errorf("%v %v parameter %v: %v", method, path, p.Name, err)
+				}
+			}
+			if op.RequestBody == nil {
+				continue
+			}
+			for ct, m := range op.RequestBody.Content {
+				if err := spec.compile(m.Schema); err != nil {
+					return nil, fmt.Errorf("%v %v %v body: %v", method, path, ct, err)
+				}
+			}
+		}
+	}
+	return spec, nil
+}
+
+// compile checks the references of s and everything under it and compiles
+// their patterns
+func (spec *oaSpec) compile(s *oaSchema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		_, err := spec.resolve(s)
+		return err
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.re = re
+	}
+	if a := bytes.TrimSpace(s.AdditionalProperties); len(a) > 0 {
+		switch string(a) {
+		case "false":
+			s.closed = true
+		case "true":
+		default:
+			s.extra = &oaSchema{}
+			if err := json.Unmarshal(a, s.extra); err != nil {
+				return err
+			}
+		}
+	}
+	subs := append([]*oaSchema{s.Items, s.extra}, s.OneOf...)
+	for _, p := range s.Properties {
+		subs = append(subs, p)
+	}
+	for _, sub := range subs {
+		if err := spec.compile(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (spec *oaSpec) resolve(s *oaSchema) (*oaSchema, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	if t, ok := spec.Components.Schemas[name]; ok && name != s.Ref {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown reference %v", s.Ref)
+}
+
+// validate checks v (as encoding/json decodes it) against s, naming it at
+// in the error
+func (spec *oaSpec) validate(s *oaSchema, v interface{}, at string) error {
+	s, err := spec.resolve(s)
+	if err != nil {
+		return err
+	}
+	if len(s.OneOf) > 0 {
+		matched, errs := 0, []string{}
+		for _, o := range s.OneOf {
+			if err := spec.validate(o, v, at); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				matched++
+			}
+		}
+		switch {
+		case matched == 0:
+			return fmt.Errorf("%v", strings.Join(errs, ", or "))
+		case matched > 1:
+			return fmt.Errorf("%v matches more than one of its forms", at)
+		}
+	}
+	switch s.Type {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an object", at)
+		}
+		for _, k := range s.Required {
+			if _, ok := o[k]; !ok {
+				return fmt.Errorf("%v.%v is missing", at, k)
+			}
+		}
+		for k, ov := range o {
+			if p, ok := s.Properties[k]; ok {
+				if err := spec.validate(p, ov, at+"."+k); err != nil {
+					return err
+				}
+			} else if s.closed {
+				return fmt.Errorf("%v.%v is not allowed", at, k)
+			} else if s.extra != nil {
+				if err := spec.validate(s.extra, ov, at+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an array", at)
+		}
+		if s.Items != nil {
+			for i, av := range a {
+				if err := spec.validate(s.Items, av, fmt.Sprintf("%v[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%v is not a string", at)
+		}
+		if s.re != nil && !s.re.MatchString(str) {
+			return fmt.Errorf("%v %q does not match %v", at, str, s.Pattern)
+		}
+	case "number", "integer":
+		f, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%v is not a number", at)
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return fmt.Errorf("%v %v is not an integer", at, f)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%v %v is under %v", at, f, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%v %v is over %v", at, f, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%v is not a boolean", at)
+		}
+	}
+	if len(s.Enum) > 0 {
+		for _, e := range s.Enum {
+			if e == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v %v is not one of %v", at, v, s.Enum)
+	}
+	return nil
+}
+
+// operation finds the path the document has for urlPath, and the values of
+// its {parameters}
+func (spec *oaSpec) operation(urlPath string) (map[string]*oaOperation, map[string]string) {
+	if ops, ok := spec.Paths[urlPath]; ok {
+		return ops, nil
+	}
+	segs := strings.Split(urlPath, "/")
+	for path, ops := range spec.Paths {
+		tsegs := strings.Split(path, "/")
+		if len(tsegs) != len(segs) || !strings.Contains(path, "{") {
+			continue
+		}
+		params := make(map[string]string)
+		for i, t := range tsegs {
+			if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") && segs[i] != "" {
+				params[t[1:len(t)-1]] = segs[i]
+			} else if t != segs[i] {
+				params = nil
+				break
+			}
+		}
+		if params != nil {
+			return ops, params
+		}
+	}
+	return nil, nil
+}
+
+// parameterValue reads a path or query parameter as its schema's type
+func parameterValue(s *oaSchema, raw string) interface{} {
+	if s != nil && (s.Type == "integer" || s.Type == "number") {
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f
+		}
+	}
+	return raw
+}
+
+// check validates r against op, restoring the body it reads
+func (spec *oaSpec) check(op *oaOperation, pathParams map[string]string, r *http.Request) error {
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		raw, ok := pathParams[p.Name], p.In == "path"
+		if p.In == "query" {
+			raw, ok = query.Get(p.Name), query.Get(p.Name) != ""
+		}
+		if !ok {
+			if p.Required {
+				return fmt.Errorf("%v is missing", p.Name)
+			}
+			continue
+		}
+		if err := spec.validate(p.Schema, parameterValue(p.Schema, raw), p.Name); err != nil {
+			return err
+		}
+	}
+	rb := op.RequestBody
+	if rb == nil || r.Body == nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not read body: %v", err)
+	}
+	if int64(len(b)) > maxBody {
+		return fmt.Errorf("body is over %v bytes", maxBody)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if len(bytes.TrimSpace(b)) == 0 {
+		if rb.Required {
+			return fmt.Errorf("body is missing")
+		}
+		return nil
+	}
+	if m, ok := rb.Content["application/json"]; ok {
+		var v interface{}
+		if json.Unmarshal(b, &v) == nil {
+			return spec.validate(m.Schema, v, "body")
+		}
+	}
+	if m, ok := rb.Content["text/plain"]; ok {
+		return spec.validate(m.Schema, string(b), "body")
+	}
+	return fmt.Errorf("body is not json")
+}
+
+// validating checks every request the document describes before passing it
+// on to next
+func validating(spec *oaSpec) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ops, pathParams := spec.operation(r.URL.Path)
+			if ops == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			method := strings.ToLower(r.Method)
+			if method == "head" {
+				method = "get"
+			}
+			op, ok := ops[method]
+			if !ok {
+				allow := []string{}
+				for m := range ops {
+					allow = append(allow, strings.ToUpper(m))
+				}
+				sort.Strings(allow)
+				w.Header().Set("Allow", strings.Join(allow, ", "))
+				writeError(w, http.StatusMethodNotAllowed, "%v not allowed on %v, only %v", r.Method, r.URL.Path, strings.Join(allow, ", "))
+				return
+			}
+			if err := spec.check(op, pathParams, r); err != nil {
+				writeError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recovering answers 500 when a handler panics instead of letting it take
+// the connection down
+func recovering(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			fmt.Printf(" %v %v panic -- %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			publishError(-1, fmt.Sprintf("%v %v: %v", r.Method, r.URL.Path, err))
+			writeError(w, http.StatusInternalServerError, "internal error: %v", err)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testSpec = `{
+  "paths": {},
+  "components": {"schemas": {
+    "Cell": {"type": "object", "required": ["x", "y"], "additionalProperties": false,
+      "properties": {"x": {"type": "integer"}, "y": {"type": "integer"}}},
+    "Move": {"type": "string", "pattern": "^[fbr],-?[0-9]+$"},
+    "Jog": {"oneOf": [{"$ref": "#/components/schemas/Move"}, {"type": "string", "enum": ["x"]}]},
+    "Goal": {"type": "object", "required": ["id"],
+      "properties": {"id": {"type": "integer", "minimum": 0, "maximum": 9},
+        "goal": {"$ref": "#/components/schemas/Cell"}, "hurry": {"type": "boolean"}},
+      "additionalProperties": {"type": "number"}},
+    "Path": {"type": "array", "items": {"$ref": "#/components/schemas/Cell"}}
+  }}
+}`
+
+func TestSpecValidate(t *testing.T) {
+	spec, err := loadSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("loadSpec: %v", err)
+	}
+	tests := []struct {
+		schema  string
+		body    string
+		wantErr string // "" is valid
+	}{
+		{"Cell", `{"x": 1, "y": -2}`, ""},
+		{"Cell", `{"x": 1}`, "body.y is missing"},
+		{"Cell", `{"x": 1.5, "y": 0}`, "body.x 1.5 is not an integer"},
+		{"Cell", `{"x": 1, "y": 2, "z": 3}`, "body.z is not allowed"},
+		{"Cell", `[1, 2]`, "body is not an object"},
+		{"Move", `"f,10"`, ""},
+		{"Move", `"r,-90"`, ""},
+		{"Move", `"q,10"`, "does not match"},
+		{"Move", `10`, "body is not a string"},
+		{"Jog", `"x"`, ""},
+		{"Jog", `"b,5"`, ""},
+		{"Jog", `"y"`, "is not one of"},
+		{"Goal", `{"id": 3, "goal": {"x": 0, "y": 0}, "hurry": true, "lambda": 0.5}`, ""},
+		{"Goal", `{"id": 10}`, "body.id 10 is over 9"},
+		{"Goal", `{"id": -1}`, "body.id -1 is under 0"},
+		{"Goal", `{"id": 1, "hurry": "yes"}`, "body.hurry is not a boolean"},
+		{"Goal", `{"id": 1, "goal": {"x": 0}}`, "body.goal.y is missing"},
+		{"Goal", `{"id": 1, "lambda": "big"}`, "body.lambda is not a number"},
+		{"Path", `[{"x": 0, "y": 0}, {"x": 1, "y": 1}]`, ""},
+		{"Path", `[{"x": 0, "y": 0}, {"x": 1}]`, "body[1].y is missing"},
+		{"Path", `{}`, "body is not an array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema+" "+tt.body, func(t *testing.T) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.body), &v); err != nil {
+				t.Fatal(err)
+			}
+			err := spec.validate(spec.Components.Schemas[tt.schema], v, "body")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("validate: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("validate passed, want %q", tt.wantErr)
+			case err != nil && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("validate: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr bool
+	}{
+		{name: "embedded", doc: string(openapiJSON)},
+		{name: "test", doc: testSpec},
+		{name: "unknown reference", doc: `{"components": {"schemas": {"A": {"$ref": "#/components/schemas/B"}}}}`, wantErr: true},
+		{name: "bad pattern", doc: `{"components": {"schemas": {"A": {"type": "string", "pattern": "("}}}}`, wantErr: true},
+		{name: "not json", doc: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadSpec([]byte(tt.doc)); (err != nil) != tt.wantErr {
+				t.Fatalf("loadSpec: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
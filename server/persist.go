@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// *** MAP PERSISTENCE ***
+
+// bump whenever the snapshot layout changes, and teach loadSnapshot
+// how to read the older versions
+const snapshotVersion = 1
+
+// snapshot is everything needed to resume exploration in the same frame
+type snapshot struct {
+	Version   int         `json:"version"`
+	Time      int64       `json:"time"` // server millisecond timestamp
+	XScale    float64     `json:"xscale"`
+	YScale    float64     `json:"yscale"`
+	Localized bool        `json:"localized"`
+	Bots      []string    `json:"bots"`   // [int ID] -> "ip-addr"
+	Clocks    []int64     `json:"clocks"` // [int ID] -> clock offset
+	Poses     []pose      `json:"poses"`
+	Traj      [][]pose    `json:"traj"`
+	Paths     [][]cell    `json:"paths"`
+	Cells     []cellValue `json:"cells"` // sparse ogm
+
+	Noise map[int]motionNoise `json:"noise,omitempty"` // [int ID] -> calibrated odometry noise
+	Covs  map[int]covariance  `json:"covs,omitempty"`  // [int ID] -> pose covariance
+
+	Diagnostics  map[int][]diagnostic `json:"diagnostics,omitempty"`  // [int ID] -> bring-up check results
+	Calibrations map[int]calibration  `json:"calibrations,omitempty"` // [int ID] -> movement scales
+}
+
+type cellValue struct {
+	X int     `json:"x"`
+	Y int     `json:"y"`
+	L float64 `json:"l"` // log-odds
+}
+
+type poseJSON struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	R float64 `json:"r"`
+}
+
+func (p pose) MarshalJSON() ([]byte, error) {
+	return json.Marshal(poseJSON{X: p.x, Y: p.y, R: p.r})
+}
+
+func (p *pose) UnmarshalJSON(b []byte) error {
+	pj := poseJSON{}
+	if err := json.Unmarshal(b, &pj); err != nil {
+		return err
+	}
+	*p = pose{x: pj.X, y: pj.Y, r: pj.R}
+	return nil
+}
+
+type cellJSON struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func (c cell) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cellJSON{X: c.x, Y: c.y})
+}
+
+func (c *cell) UnmarshalJSON(b []byte) error {
+	cj := cellJSON{}
+	if err := json.Unmarshal(b, &cj); err != nil {
+		return err
+	}
+	*c = cell{x: cj.X, y: cj.Y}
+	return nil
+}
+
+// takeSnapshot copies the current state (caller must hold stateLock)
+func takeSnapshot() *snapshot {
+	s := &snapshot{
+		Version:   snapshotVersion,
+		Time:      makeTimestamp(),
+		XScale:    xscale,
+		YScale:    yscale,
+		Localized: localized,
+		Bots:      append([]string{}, bot...),
+		Clocks:    append([]int64{}, clocks...),
+		Poses:     append([]pose{}, pos...),
+		Noise:     make(map[int]motionNoise),
+		Covs:      make(map[int]covariance),
+
+		Diagnostics:  make(map[int][]diagnostic),
+		Calibrations: make(map[int]calibration),
+	}
+	for id, mn := range noises {
+		s.Noise[id] = mn
+	}
+	for id, P := range poseCovs {
+		s.Covs[id] = P
+	}
+	for id, ds := range diagnostics {
+		s.Diagnostics[id] = append([]diagnostic{}, ds...)
+	}
+	calLock.RLock()
+	for id, c := range calibrations {
+		s.Calibrations[id] = c
+	}
+	calLock.RUnlock()
+	for _, t := range traj {
+		s.Traj = append(s.Traj, append([]pose{}, t...))
+	}
+	for _, p := range paths {
+		s.Paths = append(s.Paths, append([]cell{}, p...))
+	}
+	for k, v := range ogm {
+		s.Cells = append(s.Cells, cellValue{X: k.x, Y: k.y, L: v})
+	}
+	// stable output makes snapshots diffable
+	sort.Slice(s.Cells, func(i, j int) bool {
+		if s.Cells[i].X != s.Cells[j].X {
+			return s.Cells[i].X < s.Cells[j].X
+		}
+		return s.Cells[i].Y < s.Cells[j].Y
+	})
+	return s
+}
+
+// errSnapshotKept is saveSnapshot refusing to replace a snapshot with an
+// empty one
+var errSnapshotKept = errors.New("this run has no map or trajectories yet")
+
+// empty reports whether s has nothing a restart without -load would lose
+func (s *snapshot) empty() bool {
+	for _, t := range s.Traj {
+		if len(t) > 0 {
+			return false
+		}
+	}
+	return len(s.Cells) == 0
+}
+
+// saveSnapshot writes the state to filename, via a temp file + rename so a
+// crash mid-write never leaves a truncated snapshot behind. An existing
+// file is left alone until this run has a map or trajectories, so a
+// restart that forgot -load does not wipe the last one
+func saveSnapshot(filename string) error {
+	stateLock.RLock()
+	s := takeSnapshot()
+	stateLock.RUnlock()
+	if s.empty() {
+		if _, err := os.Stat(filename); err == nil {
+			return fmt.Errorf("not overwriting %v: %w", filename, errSnapshotKept)
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func readSnapshot(filename string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	if s.Version < 1 || s.Version > snapshotVersion {
+		return nil, fmt.Errorf("%v: unsupported snapshot version %v", filename, s.Version)
+	}
+	if s.XScale != xscale || s.YScale != yscale {
+		return nil, fmt.Errorf("%v: cell scale %vx%v does not match %vx%v", filename, s.XScale, s.YScale, xscale, yscale)
+	}
+	return s, nil
+}
+
+// loadSnapshot replaces the current state with the one in filename
+func loadSnapshot(filename string) error {
+	s, err := readSnapshot(filename)
+	if err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	bot = s.Bots
+	clocks = s.Clocks
+	pos = s.Poses
+	localized = s.Localized
+	traj = s.Traj
+	paths = s.Paths
+	// every registered bot needs a (possibly empty) trajectory and path
+	for len(traj) < len(bot) {
+		traj = append(traj, []pose{})
+	}
+	for len(paths) < len(bot) {
+		paths = append(paths, []cell{})
+	}
+	botStates = make([]botState, len(bot))
+	noises = make(map[int]motionNoise)
+	for id, mn := range s.Noise {
+		noises[id] = mn
+	}
+	poseCovs = make(map[int]covariance)
+	for id, P := range s.Covs {
+		poseCovs[id] = P
+	}
+	diagnostics = make(map[int][]diagnostic)
+	for id, ds := range s.Diagnostics {
+		diagnostics[id] = ds
+	}
+	calLock.Lock()
+	calibrations = make(map[int]calibration)
+	for id, c := range s.Calibrations {
+		calibrations[id] = c
+	}
+	calLock.Unlock()
+	filters = make(map[int]*particleFilter)
+	rangeWanted = make(map[int]bool)
+	ogm = make(map[cell]float64)
+	for _, c := range s.Cells {
+		ogm[cell{x: c.X, y: c.Y}] = c.L
+	}
+	resetLocalMaps()
+	return nil
+}
+
+// snapshotLoop saves the state every period until ctx is done
+func snapshotLoop(ctx context.Context, filename string, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	kept := false // told the operator the old snapshot is kept
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := saveSnapshot(filename)
+			if errors.Is(err, errSnapshotKept) {
+				if !kept {
+					fmt.Printf(" %v, -load it to resume.\n", err)
+				}
+				kept = true
+			} else if err != nil {
+				fmt.Printf(" snapshot error -- %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// *** A* PATH PLANNING ***
+
+var (
+	robotRadius  float64 = 8   // cm, occupied cells are inflated by this much, -robot-radius
+	unknownCost  float64 = 2   // cost multiplier for moving through unknown cells, -unknown-cost
+	planMargin   int     = 5   // cells the search may leave the known map by
+	maxPlanNode  int     = 1e5 // give up after expanding this many cells
+	planAttempts int     = 3   // goals to ask the policy for before a bot idles
+)
+
+var errNoPath = errors.New("no path")
+
+// inflatedObstacles marks every cell within robotRadius of an occupied cell
+func inflatedObstacles() map[cell]bool {
+	r := int(math.Ceil(robotRadius / math.Min(xscale, yscale)))
+	blocked := make(map[cell]bool)
+	for k, v := range ogm {
+		if v < occThresh {
+			continue
+		}
+		for i := -r; i <= r; i++ {
+			for j := -r; j <= r; j++ {
+				if i*i+j*j <= r*r {
+					blocked[cell{x: k.x + i, y: k.y + j}] = true
+				}
+			}
+		}
+	}
+	return blocked
+}
+
+// planBlocked is every cell plan keeps botID out of: the inflated
+// obstacles and the other bots (caller must hold stateLock)
+func planBlocked(botID int) map[cell]bool {
+	blocked := inflatedObstacles()
+	for c := range otherRobots(botID) {
+		blocked[c] = true
+	}
+	return blocked
+}
+
+// octile distance, the exact cost of an unobstructed 8-connected grid path
+func octile(a, b cell) float64 {
+	dx := math.Abs(float64(a.x - b.x))
+	dy := math.Abs(float64(a.y - b.y))
+	return dx + dy + (math.Sqrt2-2)*math.Min(dx, dy)
+}
+
+type astarNode struct {
+	c     cell
+	f     float64
+	index int
+}
+
+type astarQueue []*astarNode
+
+func (q astarQueue) Len() int           { return len(q) }
+func (q astarQueue) Less(i, j int) bool { return q[i].f < q[j].f }
+func (q astarQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *astarQueue) Push(x interface{}) {
+	node := x.(*astarNode)
+	node.index = len(*q)
+	*q = append(*q, node)
+}
+func (q *astarQueue) Pop() interface{} {
+	old := *q
+	node := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return node
+}
+
+// plan returns the cells from start (exclusive) to goal (inclusive) of the
+// cheapest 8-connected path for botID that keeps the robot footprint off
+// obstacles and other bots, never cuts a corner between two blocked cells,
+// and stays out of cells other bots reserved for the time it gets there
+// (caller must hold stateLock)
+func plan(start, goal cell, botID int) ([]cell, error) {
+	if start == goal {
+		// nowhere to go, the policy should find another goal
+		return nil, fmt.Errorf("plan %v -> %v: already there: %w", start, goal, errNoPath)
+	}
+	blocked := planBlocked(botID)
+	if blocked[goal] {
+		return nil, fmt.Errorf("plan %v -> %v: goal is blocked: %w", start, goal, errNoPath)
+	}
+	// limit the search so unknown space does not make it unbounded
+	lo, hi, _ := knownBounds()
+	lo, hi = boundsWith(lo, hi, start, goal)
+	lo = cell{x: lo.x - planMargin, y: lo.y - planMargin}
+	hi = cell{x: hi.x + planMargin, y: hi.y + planMargin}
+	// the bot may already sit inside an inflated obstacle, let it leave
+	free := func(c cell) bool {
+		return c == start || (!blocked[c] && inBounds(c, lo, hi))
+	}
+	now := time.Now()
+	steps := map[cell]int{start: 0}
+	g := map[cell]float64{start: 0}
+	cameFrom := make(map[cell]cell)
+	closed := make(map[cell]bool)
+	open := map[cell]*astarNode{}
+	Q := &astarQueue{}
+	open[start] = &astarNode{c: start, f: octile(start, goal)}
+	heap.Push(Q, open[start])
+	for Q.Len() > 0 && len(closed) < maxPlanNode {
+		node := heap.Pop(Q).(*astarNode).c
+		delete(open, node)
+		if node == goal {
+			// walk back to the start
+			path := []cell{}
+			for curr := goal; curr != start; curr = cameFrom[curr] {
+				path = append([]cell{curr}, path...)
+			}
+			return path, nil
+		}
+		closed[node] = true
+		for _, d := range neighbors8 {
+			next := add(node, d)
+			if closed[next] || !free(next) {
+				continue
+			}
+			if reservedByOther(next, now.Add(time.Duration(steps[node]+1)*cellTime), botID) {
+				continue
+			}
+			// diagonal moves need both orthogonal cells open (no corner cutting)
+			if d.x != 0 && d.y != 0 && (!free(cell{x: node.x + d.x, y: node.y}) || !free(cell{x: node.x, y: node.y + d.y})) {
+				continue
+			}
+			step := 1.0
+			if d.x != 0 && d.y != 0 {
+				step = math.Sqrt2
+			}
+			if isUnknown(next) {
+				step *= unknownCost
+			}
+			cost := g[node] + step
+			if old, seen := g[next]; seen && cost >= old {
+				continue
+			}
+			g[next] = cost
+			steps[next] = steps[node] + 1
+			cameFrom[next] = node
+			if n, ok := open[next]; ok {
+				n.f = cost + octile(next, goal)
+				heap.Fix(Q, n.index)
+			} else {
+				open[next] = &astarNode{c: next, f: cost + octile(next, goal)}
+				heap.Push(Q, open[next])
+			}
+		}
+	}
+	return nil, fmt.Errorf("plan %v -> %v: %w", start, goal, errNoPath)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// ring is the square of cells r away from c
+func ring(c cell, r int) []cell {
+	cs := []cell{}
+	for i := -r; i <= r; i++ {
+		for j := -r; j <= r; j++ {
+			if i == -r || i == r || j == -r || j == r {
+				cs = append(cs, cell{x: c.x + i, y: c.y + j})
+			}
+		}
+	}
+	return cs
+}
+
+func TestPlan(t *testing.T) {
+	defer func(m map[cell]float64, p []pose, b []string, rr, uc float64, rs map[cell][]reservation) {
+		ogm, pos, bot, robotRadius, unknownCost, reservations = m, p, b, rr, uc, rs
+	}(ogm, pos, bot, robotRadius, unknownCost, reservations)
+	pos, bot = nil, nil
+	reservations = make(map[cell][]reservation)
+
+	tests := []struct {
+		name        string
+		free        [2]cell // box of known free cells
+		walls       []cell
+		radius      float64 // cm
+		unknownCost float64
+		start, goal cell
+		want        []cell // nil checks only that a path reaches goal
+		wantErr     error
+	}{
+		{
+			name:        "already there",
+			free:        [2]cell{{0, 0}, {4, 4}},
+			unknownCost: 2,
+			start:       cell{2, 2},
+			goal:        cell{2, 2},
+			wantErr:     errNoPath,
+		},
+		{
+			name:        "straight",
+			free:        [2]cell{{0, 0}, {4, 0}},
+			unknownCost: 2,
+			start:       cell{0, 0},
+			goal:        cell{4, 0},
+			want:        []cell{{1, 0}, {2, 0}, {3, 0}, {4, 0}},
+		},
+		{
+			name:        "through cheap unknown",
+			free:        [2]cell{{0, 1}, {4, 1}},
+			unknownCost: 1,
+			start:       cell{0, 0},
+			goal:        cell{4, 0},
+			want:        []cell{{1, 0}, {2, 0}, {3, 0}, {4, 0}},
+		},
+		{
+			name:        "around dear unknown",
+			free:        [2]cell{{0, 1}, {4, 1}},
+			unknownCost: 10,
+			start:       cell{0, 0},
+			goal:        cell{4, 0},
+			want:        []cell{{1, 1}, {2, 1}, {3, 1}, {4, 0}},
+		},
+		{
+			name:        "no corner cutting",
+			free:        [2]cell{{-3, -3}, {3, 3}},
+			walls:       []cell{{1, 0}, {0, 1}},
+			unknownCost: 2,
+			start:       cell{0, 0},
+			goal:        cell{1, 1},
+		},
+		{
+			name:        "goal inflated",
+			free:        [2]cell{{-3, -3}, {3, 3}},
+			walls:       []cell{{3, 0}},
+			radius:      10,
+			unknownCost: 2,
+			start:       cell{0, 0},
+			goal:        cell{2, 0},
+			wantErr:     errNoPath,
+		},
+		{
+			name:        "walled in",
+			free:        [2]cell{{-5, -5}, {15, 15}},
+			walls:       ring(cell{10, 10}, 3),
+			radius:      10,
+			unknownCost: 2,
+			start:       cell{0, 0},
+			goal:        cell{10, 10},
+			wantErr:     errNoPath,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			knownFree(ogm, tt.free[0], tt.free[1])
+			knownFree(ogm, tt.start, tt.start)
+			knownFree(ogm, tt.goal, tt.goal)
+			for _, w := range tt.walls {
+				ogm[w] = 2 * occThresh
+			}
+			robotRadius, unknownCost = tt.radius, tt.unknownCost
+			path, err := plan(tt.start, tt.goal, 0)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("plan = %v, %v; want %v", path, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("plan: %v", err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(path, tt.want) {
+				t.Fatalf("plan = %v, want %v", path, tt.want)
+			}
+			if path[len(path)-1] != tt.goal {
+				t.Fatalf("plan = %v, does not end at %v", path, tt.goal)
+			}
+			walls := make(map[cell]bool)
+			for _, w := range tt.walls {
+				walls[w] = true
+			}
+			prev := tt.start
+			for _, c := range path {
+				dx, dy := c.x-prev.x, c.y-prev.y
+				if walls[c] || math.Abs(float64(dx)) > 1 || math.Abs(float64(dy)) > 1 {
+					t.Fatalf("plan = %v, bad step %v -> %v", path, prev, c)
+				}
+				if dx != 0 && dy != 0 && (walls[cell{x: c.x, y: prev.y}] || walls[cell{x: prev.x, y: c.y}]) {
+					t.Fatalf("plan = %v, cuts the corner %v -> %v", path, prev, c)
+				}
+				prev = c
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// *** EXPLORATION POLICIES ***
+
+// Policy decides where an exploring bot goes next. policy() owns the pose
+// update, sensing, map update and command dispatch; a Policy only ever
+// chooses goals. Every method is called with stateLock held.
+type Policy interface {
+	// NextGoal returns the cell botID should plan to next, or false when
+	// the policy has nothing left for it to do
+	NextGoal(botID int, from cell) (cell, bool)
+	// OnMeasurement sees every ultrasonic reading folded into the ogm,
+	// from the bot's cell to the cell the echo came back from
+	OnMeasurement(botID int, from, hit cell)
+	// OnPlanFailed hears that plan found no way to the goal NextGoal gave
+	// botID, so it is not handed out again
+	OnPlanFailed(botID int, goal cell)
+}
+
+// policyParams are the numeric knobs of a policy, by name
+type policyParams map[string]float64
+
+// get returns params[key], or def if it was not given
+func (pp policyParams) get(key string, def float64) float64 {
+	if v, ok := pp[key]; ok {
+		return v
+	}
+	return def
+}
+
+// policies are constructors of every Policy that /explore can run, by name
+var policies = map[string]func(params policyParams) (Policy, error){
+	"random":     newRandomPolicy,
+	"frontier":   newFrontierPolicy,
+	"wallfollow": newWallFollowPolicy,
+	"coverage":   newCoveragePolicy,
+	"auction":    newAuctionPolicy,
+}
+
+var (
+	defaultPolicy string = "random"
+	activePolicy  Policy // policy of the running exploration
+)
+
+func policyNames() string {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newPolicy(name string, params policyParams) (Policy, error) {
+	if name == "" {
+		name = defaultPolicy
+	}
+	newP, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q (have %v)", name, policyNames())
+	}
+	return newP(params)
+}
+
+// random: the original random/greedy policy
+//  -- pick K random cells within ±radius of the bot
+//  -- select the one that minimizes abs(occupancy) value
+
+type randomPolicy struct {
+	k      int
+	radius int
+}
+
+func newRandomPolicy(params policyParams) (Policy, error) {
+	rp := &randomPolicy{k: int(params.get("k", 10)), radius: int(params.get("radius", 2))}
+	if rp.k < 1 || rp.radius < 1 {
+		return nil, fmt.Errorf("random: k and radius must be >= 1")
+	}
+	return rp, nil
+}
+
+func (rp *randomPolicy) NextGoal(botID int, from cell) (cell, bool) {
+	return randomGoal(from, rp.k, rp.radius), true
+}
+
+func (rp *randomPolicy) OnMeasurement(botID int, from, hit cell) {}
+
+func (rp *randomPolicy) OnPlanFailed(botID int, goal cell) {}
+
+func randomGoal(from cell, K int, radius int) cell {
+	randCells := make([]cell, 0)
+	for i := 0; i < K; i++ {
+		xDelta := rand.Intn(radius) + 1
+		yDelta := rand.Intn(radius) + 1
+		if rand.Intn(2)%2 == 0 {
+			xDelta *= -1
+		}
+		if rand.Intn(2)%2 == 0 {
+			yDelta *= -1
+		}
+		randCells = append(randCells, cell{from.x + xDelta, from.y + yDelta})
+	}
+	minIdx := 0
+	for i := 0; i < len(randCells); i++ {
+		if math.Abs(ogm[randCells[i]]) < math.Abs(ogm[randCells[minIdx]]) {
+			minIdx = i
+		}
+	}
+	return randCells[minIdx]
+}
+
+// wallfollow: keep the nearest wall on the bot's left
+//  -- approach the last wall we measured until standoff cells away
+//  -- then step along it, turning right around convex corners
+
+type wallFollowPolicy struct {
+	standoff int
+	step     int
+	walls    map[int]cell // [botID] -> last ultrasonic hit
+}
+
+func newWallFollowPolicy(params policyParams) (Policy, error) {
+	wp := &wallFollowPolicy{
+		standoff: int(params.get("standoff", 2)),
+		step:     int(params.get("step", 3)),
+		walls:    make(map[int]cell),
+	}
+	if wp.standoff < 1 || wp.step < 1 {
+		return nil, fmt.Errorf("wallfollow: standoff and step must be >= 1")
+	}
+	return wp, nil
+}
+
+func (wp *wallFollowPolicy) OnMeasurement(botID int, from, hit cell) {
+	if ogm[hit] >= occThresh {
+		wp.walls[botID] = hit
+	}
+}
+
+// OnPlanFailed forgets the wall, the bot wanders until it finds another
+func (wp *wallFollowPolicy) OnPlanFailed(botID int, goal cell) {
+	delete(wp.walls, botID)
+}
+
+func (wp *wallFollowPolicy) NextGoal(botID int, from cell) (cell, bool) {
+	wall, ok := wp.walls[botID]
+	if !ok {
+		// no wall yet, wander until the ultrasonic finds one
+		return randomGoal(from, 10, 2), true
+	}
+	dx := float64(wall.x - from.x)
+	dy := float64(wall.y - from.y)
+	d := math.Hypot(dx, dy)
+	if d == 0 {
+		return randomGoal(from, 10, 2), true
+	}
+	ux, uy := dx/d, dy/d // unit vector toward the wall
+	if d > float64(wp.standoff)+1 {
+		// approach
+		a := d - float64(wp.standoff)
+		return cell{x: from.x + int(math.Round(ux*a)), y: from.y + int(math.Round(uy*a))}, true
+	}
+	// wall on the left means walking along (uy, -ux)
+	tx, ty := uy, -ux
+	for turn := 0; turn < 4; turn++ {
+		goal := cell{x: from.x + int(math.Round(tx*float64(wp.step))), y: from.y + int(math.Round(ty*float64(wp.step)))}
+		if traversable(goal) {
+			return goal, true
+		}
+		// blocked ahead, turn right
+		tx, ty = ty, -tx
+	}
+	return cell{}, false
+}
+
+// coverage: boustrophedon (lawnmower) sweep of a width x height cell box
+// starting at the bot, lanes spacing cells apart; cells found occupied
+// are skipped
+
+type coveragePolicy struct {
+	width   int
+	height  int
+	spacing int
+	plans   map[int][]cell // [botID] -> remaining sweep waypoints
+}
+
+func newCoveragePolicy(params policyParams) (Policy, error) {
+	cp := &coveragePolicy{
+		width:   int(params.get("width", 20)),
+		height:  int(params.get("height", 20)),
+		spacing: int(params.get("spacing", 2)),
+		plans:   make(map[int][]cell),
+	}
+	if cp.width < 1 || cp.height < 1 || cp.spacing < 1 {
+		return nil, fmt.Errorf("coverage: width, height and spacing must be >= 1")
+	}
+	return cp, nil
+}
+
+func (cp *coveragePolicy) OnMeasurement(botID int, from, hit cell) {}
+
+// OnPlanFailed has nothing to do, NextGoal already moved past the goal
+func (cp *coveragePolicy) OnPlanFailed(botID int, goal cell) {}
+
+func (cp *coveragePolicy) sweep(from cell) []cell {
+	plan := make([]cell, 0)
+	for i, lane := 0, 0; i < cp.width; i, lane = i+cp.spacing, lane+1 {
+		bottom := cell{x: from.x + i, y: from.y}
+		top := cell{x: from.x + i, y: from.y + cp.height - 1}
+		if lane%2 == 0 {
+			plan = append(plan, bottom, top)
+		} else {
+			plan = append(plan, top, bottom)
+		}
+	}
+	return plan
+}
+
+func (cp *coveragePolicy) NextGoal(botID int, from cell) (cell, bool) {
+	plan, ok := cp.plans[botID]
+	if !ok {
+		plan = cp.sweep(from)
+	}
+	for len(plan) > 0 && (plan[0] == from || !traversable(plan[0])) {
+		plan = plan[1:]
+	}
+	cp.plans[botID] = plan
+	if len(plan) == 0 {
+		fmt.Printf(" bot %v: coverage sweep finished.\n", botID)
+		return cell{}, false
+	}
+	goal := plan[0]
+	cp.plans[botID] = plan[1:]
+	return goal, true
+}
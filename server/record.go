@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// *** RECORDING ***
+
+// -record writes the run to a file for -eval to score later: a first line
+// with the state as a snapshot, then every event as GET /events has it, one
+// json object per line
+//  -- the first line is {"type": "snapshot", "time": <ms>, "data": <snapshot>}
+//  -- a recorder that falls behind writes {"type": "dropped", ...} as the
+//     stream does
+
+var recordBuffer int = 4096 // events the recorder may fall behind by
+
+// startRecording records to filename until ctx is done, then writes what
+// is still buffered and closes done
+func startRecording(ctx context.Context, filename string) (<-chan struct{}, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	// subscribed first, so nothing between the snapshot and the events is lost
+	sub := subscribeBuffered(nil, recordBuffer)
+	stateLock.RLock()
+	s := takeSnapshot()
+	stateLock.RUnlock()
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(event{Type: "snapshot", Time: s.Time, Data: s}); err != nil {
+		unsubscribe(sub)
+		f.Close()
+		return nil, err
+	}
+	done := make(chan struct{})
+	write := func(ev *event) error {
+		if d := sub.takeDropped(); d > 0 {
+			enc.Encode(event{Type: "dropped", Time: ev.Time, Data: map[string]int{"dropped": d}})
+		}
+		return enc.Encode(ev)
+	}
+	go func() {
+		defer close(done)
+		defer f.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				// the end of the run is the part -eval scores last
+				unsubscribe(sub)
+				for {
+					select {
+					case ev := <-sub.ch:
+						if err := write(ev); err != nil {
+							fmt.Printf(" record error -- %v\n", err)
+							return
+						}
+					default:
+						return
+					}
+				}
+			case ev := <-sub.ch:
+				if err := write(ev); err != nil {
+					fmt.Printf(" record error -- %v\n", err)
+					unsubscribe(sub)
+					return
+				}
+			}
+		}
+	}()
+	return done, nil
+}
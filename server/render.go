@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+)
+
+// *** MAP RENDERING ***
+
+var (
+	renderScale    int = 8   // pixels per cell
+	renderPad      int = 2   // cells of padding around the bounding box
+	renderMaxCells int = 250 // cells either side of the origin drawn at most, the rest is cut off
+	botColors          = []color.RGBA{
+		{R: 228, G: 26, B: 28, A: 255},
+		{R: 55, G: 126, B: 184, A: 255},
+		{R: 77, G: 175, B: 74, A: 255},
+		{R: 152, G: 78, B: 163, A: 255},
+		{R: 255, G: 127, B: 0, A: 255},
+		{R: 166, G: 86, B: 40, A: 255},
+	}
+)
+
+func botColor(botID int) color.RGBA {
+	return botColors[botID%len(botColors)]
+}
+
+// finite reports whether p is somewhere, a bad fix can leave NaN or Inf
+func finite(p pose) bool {
+	for _, v := range []float64{p.x, p.y, p.r} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// clampCell keeps c within renderMaxCells of the origin
+func clampCell(c cell) cell {
+	clamp := func(v int) int {
+		if v < -renderMaxCells {
+			return -renderMaxCells
+		}
+		if v > renderMaxCells {
+			return renderMaxCells
+		}
+		return v
+	}
+	return cell{x: clamp(c.x), y: clamp(c.y)}
+}
+
+// mapBounds returns the (inclusive) cell bounding box of everything we draw,
+// no more than renderMaxCells from the origin
+func mapBounds() (cell, cell) {
+	lo := cell{x: 0, y: 0}
+	hi := cell{x: 0, y: 0}
+	grow := func(c cell) {
+		if c.x < lo.x {
+			lo.x = c.x
+		}
+		if c.y < lo.y {
+			lo.y = c.y
+		}
+		if c.x > hi.x {
+			hi.x = c.x
+		}
+		if c.y > hi.y {
+			hi.y = c.y
+		}
+	}
+	for k := range ogm {
+		grow(k)
+	}
+	for _, t := range traj {
+		for _, p := range t {
+			if finite(p) {
+				grow(binPose(p))
+			}
+		}
+	}
+	for _, p := range pos {
+		if finite(p) {
+			grow(binPose(p))
+		}
+	}
+	for _, path := range paths {
+		for _, c := range path {
+			grow(c)
+		}
+	}
+	lo.x -= renderPad
+	lo.y -= renderPad
+	hi.x += renderPad
+	hi.y += renderPad
+	return clampCell(lo), clampCell(hi)
+}
+
+// mapCanvas converts between world (cm) coordinates and image pixels
+// (image y grows downward, world y grows upward)
+type mapCanvas struct {
+	img *image.RGBA
+	lo  cell
+	hi  cell
+}
+
+// contains reports whether world point x, y cm falls on the canvas
+func (mc *mapCanvas) contains(x, y float64) bool {
+	return finite(pose{x: x, y: y}) &&
+		x >= float64(mc.lo.x)*xscale && x < float64(mc.hi.x+1)*xscale &&
+		y >= float64(mc.lo.y)*yscale && y < float64(mc.hi.y+1)*yscale
+}
+
+func (mc *mapCanvas) pixel(x, y float64) (int, int) {
+	px := (x/xscale - float64(mc.lo.x)) * float64(renderScale)
+	py := (float64(mc.hi.y+1) - y/yscale) * float64(renderScale)
+	return int(px), int(py)
+}
+
+func (mc *mapCanvas) cellCenter(c cell) (int, int) {
+	return mc.pixel((float64(c.x)+0.5)*xscale, (float64(c.y)+0.5)*yscale)
+}
+
+func (mc *mapCanvas) line(x0, y0, x1, y1 int, c color.RGBA) {
+	// bresenham
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx := sign(x1 - x0)
+	sy := sign(y1 - y0)
+	e := dx + dy
+	for {
+		mc.img.SetRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func (mc *mapCanvas) dot(x, y, radius int, c color.RGBA) {
+	for i := -radius; i <= radius; i++ {
+		for j := -radius; j <= radius; j++ {
+			if i*i+j*j <= radius*radius {
+				mc.img.SetRGBA(x+i, y+j, c)
+			}
+		}
+	}
+}
+
+// arrow draws pose p as a dot with a heading line and arrow head
+func (mc *mapCanvas) arrow(p pose, c color.RGBA) {
+	length := 2.5 * float64(renderScale)
+	rad := p.r * math.Pi / 180
+	x0, y0 := mc.pixel(p.x, p.y)
+	// image y is flipped
+	x1 := x0 + int(length*math.Cos(rad))
+	y1 := y0 - int(length*math.Sin(rad))
+	mc.line(x0, y0, x1, y1, c)
+	for _, side := range []float64{-1, 1} {
+		h := rad + math.Pi - side*math.Pi/6
+		mc.line(x1, y1, x1+int(length/2*math.Cos(h)), y1-int(length/2*math.Sin(h)), c)
+	}
+	mc.dot(x0, y0, renderScale/3+1, c)
+}
+
+// occupancy log-odds -> grayscale, unknown (0) is mid gray
+func occupancyGray(l float64) color.RGBA {
+	p := 1 - 1/(1+math.Exp(l))
+	g := uint8(255 * (1 - p))
+	return color.RGBA{R: g, G: g, B: g, A: 255}
+}
+
+// renderMap draws the OGM, trajectories, poses and planned paths; what
+// lies off the canvas is left out (caller must hold stateLock)
+func renderMap() (*image.RGBA, error) {
+	lo, hi := mapBounds()
+	w := (hi.x - lo.x + 1) * renderScale
+	h := (hi.y - lo.y + 1) * renderScale
+	if max := (2*renderMaxCells + 1) * renderScale; w <= 0 || h <= 0 || w > max || h > max {
+		return nil, fmt.Errorf("map of %vx%v pixels is not drawable", w, h)
+	}
+	mc := &mapCanvas{img: image.NewRGBA(image.Rect(0, 0, w, h)), lo: lo, hi: hi}
+	// occupancy
+	for i := lo.x; i <= hi.x; i++ {
+		for j := lo.y; j <= hi.y; j++ {
+			g := occupancyGray(ogm[cell{x: i, y: j}])
+			px := (i - lo.x) * renderScale
+			py := (hi.y - j) * renderScale
+			for a := 0; a < renderScale; a++ {
+				for b := 0; b < renderScale; b++ {
+					mc.img.SetRGBA(px+a, py+b, g)
+				}
+			}
+		}
+	}
+	// planned paths (lighter, from bot to goal)
+	for id, path := range paths {
+		if len(path) == 0 || id >= len(pos) {
+			continue
+		}
+		c := lighten(botColor(id))
+		if !mc.contains(pos[id].x, pos[id].y) {
+			continue
+		}
+		x0, y0 := mc.pixel(pos[id].x, pos[id].y)
+		for _, p := range path {
+			if !mc.contains((float64(p.x)+0.5)*xscale, (float64(p.y)+0.5)*yscale) {
+				break
+			}
+			x1, y1 := mc.cellCenter(p)
+			mc.line(x0, y0, x1, y1, c)
+			mc.dot(x1, y1, 1, c)
+			x0, y0 = x1, y1
+		}
+	}
+	// trajectories
+	for id, t := range traj {
+		c := botColor(id)
+		for i := 1; i < len(t); i++ {
+			if !mc.contains(t[i-1].x, t[i-1].y) || !mc.contains(t[i].x, t[i].y) {
+				continue
+			}
+			x0, y0 := mc.pixel(t[i-1].x, t[i-1].y)
+			x1, y1 := mc.pixel(t[i].x, t[i].y)
+			mc.line(x0, y0, x1, y1, c)
+		}
+	}
+	// current poses
+	for id, p := range pos {
+		if finite(p) && mc.contains(p.x, p.y) {
+			mc.arrow(p, botColor(id))
+		}
+	}
+	return mc.img, nil
+}
+
+func writeMapPNG(w io.Writer) error {
+	stateLock.RLock()
+	img, err := renderMap()
+	stateLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+func saveMapPNG(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeMapPNG(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("saved map to %v\n", filename)
+	return nil
+}
+
+// lighten blends c halfway toward white
+func lighten(c color.RGBA) color.RGBA {
+	return color.RGBA{R: c.R/2 + 128, G: c.G/2 + 128, B: c.B/2 + 128, A: 255}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
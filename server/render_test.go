@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRenderMap(t *testing.T) {
+	defer func(m map[cell]float64, p []pose, tr [][]pose, ps [][]cell) {
+		ogm, pos, traj, paths = m, p, tr, ps
+	}(ogm, pos, traj, paths)
+	max := (2*renderMaxCells + 1) * renderScale
+	tests := []struct {
+		name  string
+		cells []cell
+		pos   []pose
+		paths [][]cell
+	}{
+		{name: "empty"},
+		{name: "small", cells: []cell{{3, 4}, {-2, 1}}, pos: []pose{{10, 20, 90}}},
+		{name: "nan pose", pos: []pose{{math.NaN(), 0, 0}, {10, 10, math.NaN()}}},
+		{name: "inf pose", pos: []pose{{math.Inf(1), math.Inf(-1), 0}}},
+		{name: "far reading", cells: []cell{{0, 0}, {1e7, -1e7}}},
+		{name: "far path", pos: []pose{{0, 0, 0}}, paths: [][]cell{{{1, 1}, {1e6, 1e6}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			for _, c := range tt.cells {
+				ogm[c] = 2 * occThresh
+			}
+			pos, traj, paths = tt.pos, [][]pose{tt.pos}, tt.paths
+			img, err := renderMap()
+			if err != nil {
+				t.Fatalf("renderMap: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > max || b.Dy() > max {
+				t.Fatalf("renderMap drew %v, want at most %vx%v", b, max, max)
+			}
+		})
+	}
+}
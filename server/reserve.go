@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// *** MULTI-ROBOT COLLISION AVOIDANCE ***
+
+// prioritized planning: every plan reserves the cells it will drive
+// through, each for the window the bot is expected to be in it; bots that
+// plan later route around those reservations and around the cells the
+// other bots stand in right now
+
+var (
+	cellTime    time.Duration = 3 * time.Second // expected time to cross one cell, rotation included
+	robotCells  int           = 1               // cells around another bot's pose that are off limits
+	headOnCells int           = 4               // how far ahead two plans are checked for a head-on meeting
+	backoffDist int           = 20              // cm the yielding bot of a deadlock backs off
+	retryDelay  time.Duration = 2 * time.Second // wait before a blocked bot plans again
+)
+
+type reservation struct {
+	botID int
+	from  time.Time
+	to    time.Time
+}
+
+var (
+	reservations  = make(map[cell][]reservation) // cell -> who is passing through, when
+	reservedPaths = make(map[int][]cell)         // [botID] -> dense path it reserved
+)
+
+// densePath fills in every cell between the waypoints of a path
+func densePath(start cell, path []cell) []cell {
+	dense := []cell{}
+	prev := start
+	for _, c := range path {
+		dense = append(dense, lineCells(prev, c)[1:]...)
+		prev = c
+	}
+	return dense
+}
+
+// releaseReservations drops every reservation botID holds, and any that
+// have expired (caller must hold stateLock)
+func releaseReservations(botID int) {
+	now := time.Now()
+	for c, rs := range reservations {
+		kept := rs[:0]
+		for _, r := range rs {
+			if r.botID != botID && r.to.After(now) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(reservations, c)
+		} else {
+			reservations[c] = kept
+		}
+	}
+	delete(reservedPaths, botID)
+}
+
+// reservePath books the cells of path for botID, starting now
+// (caller must hold stateLock)
+func reservePath(botID int, start cell, path []cell) {
+	releaseReservations(botID)
+	now := time.Now()
+	dense := densePath(start, path)
+	for i, c := range dense {
+		// allow a step of slack either side, the timing is a rough guess
+		reservations[c] = append(reservations[c], reservation{
+			botID: botID,
+			from:  now.Add(time.Duration(i-1) * cellTime),
+			to:    now.Add(time.Duration(i+2) * cellTime),
+		})
+	}
+	reservedPaths[botID] = dense
+}
+
+// reservedByOther reports whether another bot has booked c at time t
+func reservedByOther(c cell, t time.Time, botID int) bool {
+	for _, r := range reservations[c] {
+		if r.botID != botID && !t.Before(r.from) && t.Before(r.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherRobots returns the cells the other bots' bodies cover right now
+func otherRobots(botID int) map[cell]bool {
+	blocked := make(map[cell]bool)
+	for id, p := range pos {
+		if id == botID || id >= len(bot) {
+			continue
+		}
+		c := binPose(p)
+		for i := -robotCells; i <= robotCells; i++ {
+			for j := -robotCells; j <= robotCells; j++ {
+				blocked[cell{x: c.x + i, y: c.y + j}] = true
+			}
+		}
+	}
+	return blocked
+}
+
+// ahead returns the next headOnCells of botID's reserved path, counted
+// from the path cell closest to where the bot is now
+func ahead(botID int) []cell {
+	path := reservedPaths[botID]
+	if len(path) == 0 {
+		return nil
+	}
+	me := binPose(pos[botID])
+	closest := 0
+	for i, c := range path {
+		if euclDist(float64(c.x), float64(c.y), float64(me.x), float64(me.y)) <
+			euclDist(float64(path[closest].x), float64(path[closest].y), float64(me.x), float64(me.y)) {
+			closest = i
+		}
+	}
+	path = path[closest:]
+	if len(path) > headOnCells {
+		path = path[:headOnCells]
+	}
+	return path
+}
+
+// headOn returns a bot whose next few reserved cells run into botID while
+// botID's next few run into it, ie two bots facing off in a corridor
+// (caller must hold stateLock)
+func headOn(botID int) (int, bool) {
+	mine := ahead(botID)
+	near := func(path []cell, c cell) bool {
+		for _, p := range path {
+			if abs(p.x-c.x) <= robotCells && abs(p.y-c.y) <= robotCells {
+				return true
+			}
+		}
+		return false
+	}
+	me := binPose(pos[botID])
+	for id := range reservedPaths {
+		if id == botID || id >= len(pos) {
+			continue
+		}
+		if near(mine, binPose(pos[id])) && near(ahead(id), me) {
+			return id, true
+		}
+	}
+	return -1, false
+}
+
+// nearestRobot returns some other bot within reach cells of botID
+func nearestRobot(botID int, reach int) (int, bool) {
+	me := binPose(pos[botID])
+	for id, p := range pos {
+		if id == botID || id >= len(bot) {
+			continue
+		}
+		c := binPose(p)
+		if abs(c.x-me.x) <= reach && abs(c.y-me.y) <= reach {
+			return id, true
+		}
+	}
+	return -1, false
+}
+
+// yields decides who gives way in a deadlock, lower IDs have priority
+func yields(botID, other int) bool {
+	return botID > other
+}
+
+// retryLater re-sparks botID's policy after retryDelay, unless the
+// exploration is stopped by then
+func retryLater(ctx context.Context, botID int) {
+	fmt.Printf("  bot %v waiting %v before planning again.\n", botID, retryDelay)
+	time.AfterFunc(retryDelay, func() {
+		select {
+		case mov <- &movPostData{ID: botID, Mov: "m"}:
+		case <-ctx.Done():
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+// at is the pose in the middle of cell c
+func at(c cell) pose {
+	return pose{x: float64(c.x)*xscale + xscale/2, y: float64(c.y)*yscale + yscale/2}
+}
+
+// row is the cells from x0 to x1 along y 0, in that order
+func row(x0, x1 int) []cell {
+	cs := []cell{}
+	step := 1
+	if x1 < x0 {
+		step = -1
+	}
+	for x := x0; x != x1+step; x += step {
+		cs = append(cs, cell{x: x, y: 0})
+	}
+	return cs
+}
+
+func TestHeadOn(t *testing.T) {
+	defer func(p []pose, rp map[int][]cell) {
+		pos, reservedPaths = p, rp
+	}(pos, reservedPaths)
+
+	tests := []struct {
+		name      string
+		other     cell   // where bot 1 is
+		otherPath []cell // and what it reserved
+		want      bool
+	}{
+		{name: "facing off", other: cell{3, 0}, otherPath: row(2, -5), want: true},
+		{name: "following", other: cell{3, 0}, otherPath: row(4, 10)},
+		{name: "too far to meet yet", other: cell{10, 0}, otherPath: row(9, -5)},
+		{name: "standing still", other: cell{3, 0}},
+		{name: "crossing away", other: cell{3, 0}, otherPath: []cell{{3, 1}, {3, 2}, {3, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos = []pose{at(cell{0, 0}), at(tt.other)}
+			reservedPaths = map[int][]cell{0: row(1, 10)}
+			if tt.otherPath != nil {
+				reservedPaths[1] = tt.otherPath
+			}
+			id, ok := headOn(0)
+			if ok != tt.want || (ok && id != 1) {
+				t.Fatalf("headOn = %v, %v; want %v", id, ok, tt.want)
+			}
+			// both see the same meeting
+			if id, ok := headOn(1); ok != tt.want || (ok && id != 0) {
+				t.Fatalf("headOn for the other bot = %v, %v; want %v", id, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestYields(t *testing.T) {
+	tests := []struct {
+		botID, other int
+		want         bool
+	}{
+		{0, 1, false},
+		{1, 0, true},
+		{2, 1, true},
+		{1, 3, false},
+	}
+	for _, tt := range tests {
+		if got := yields(tt.botID, tt.other); got != tt.want {
+			t.Fatalf("yields(%v, %v) = %v, want %v", tt.botID, tt.other, got, tt.want)
+		}
+		// exactly one of a pair gives way
+		if yields(tt.botID, tt.other) == yields(tt.other, tt.botID) {
+			t.Fatalf("yields(%v, %v) and yields(%v, %v) agree", tt.botID, tt.other, tt.other, tt.botID)
+		}
+	}
+}
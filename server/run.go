@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *** EXPLORATION RUNS ***
+
+// exploration is one run of the exploration loop: start -> (pause <->
+// resume)* -> stop. Only one runs at a time, since they would all be
+// reading the same mov channel.
+type exploration struct {
+	id       int
+	name     string // policy name
+	started  time.Time
+	duration time.Duration // 0 runs until stopped
+
+	policy Policy
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup              // in-flight policy() goroutines
+	loop   chan struct{}               // closed when the dispatch loop exits
+	cmds   chan func(run *exploration) // pause/resume/status, run on the loop goroutine
+	// only touched by the dispatch loop
+	paused  bool
+	parked  map[int]*movPostData // callbacks held back while paused (or held)
+	held    map[int]bool         // bots kept where they are for acoustic ranging
+	ranging bool                 // a rangePair is in flight
+	ranged  time.Time            // when the last periodic range was taken
+	merged  time.Time            // when the grids were last merged
+}
+
+// run status json
+type runStatus struct {
+	ID       int     `json:"id"`
+	Policy   string  `json:"policy"`
+	Started  int64   `json:"started"`  // server millisecond timestamp
+	Duration float64 `json:"duration"` // seconds, 0 runs until stopped
+	Paused   bool    `json:"paused"`
+	Parked   []int   `json:"parked"` // bots held while paused
+	Running  bool    `json:"running"`
+}
+
+var (
+	runLock  sync.Mutex   // guards current and runCount
+	current  *exploration // running exploration, if any
+	runCount int
+
+	runBots = make(map[int]bool) // [botID] -> sparked by the current run, under stateLock
+)
+
+// startExploration starts a new run with policy p, named name
+func startExploration(duration time.Duration, name string, p Policy) (*exploration, error) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if current != nil {
+		return nil, fmt.Errorf("exploration %v is already running", current.id)
+	}
+	if isEstopped() {
+		return nil, errEstopped
+	}
+	runCount++
+	run := &exploration{
+		id:       runCount,
+		name:     name,
+		started:  time.Now(),
+		duration: duration,
+		policy:   p,
+		parked:   make(map[int]*movPostData),
+		held:     make(map[int]bool),
+		ranged:   time.Now(),
+		merged:   time.Now(),
+		loop:     make(chan struct{}),
+		cmds:     make(chan func(run *exploration)),
+	}
+	run.ctx, run.cancel = context.WithCancel(context.Background())
+	current = run
+
+	stateLock.Lock()
+	if !localized {
+		// assume the bots are localized:
+		// and are pointing forward
+		pos = append(pos, []pose{pose{0, 0, 90}, pose{127, 0, 90}, pose{0, 127, 90}}...)
+		for id := 0; id < len(bot) && id < len(pos); id++ {
+			publishFix(id, "assumed")
+		}
+		// example trajectory
+		// paths[0] = []cell{cell{0, 1}, cell{1, 0}, cell{0, -1}, cell{-1, 0}, cell{0, 1}, cell{0, 0}}
+		localized = true
+	}
+	activePolicy = p
+	// goals held from a previous exploration are stale
+	botjobs = make(map[int]bool)
+	botids = make(map[cell]int)
+	reservations = make(map[cell][]reservation)
+	reservedPaths = make(map[int][]cell)
+	// particles start over around wherever the bots are now
+	filters = make(map[int]*particleFilter)
+	rangeWanted = make(map[int]bool)
+	// grids start over where the bots are, on top of the map so far
+	resetLocalMaps()
+	for id := range botStates {
+		stopMovTimer(id)
+		paths[id] = nil
+		setState(id, stateIdle, fmt.Sprintf("exploration %v", run.id))
+	}
+	// only bots with a pose can be explored with
+	sparks := len(bot)
+	if len(pos) < sparks {
+		sparks = len(pos)
+	}
+	runBots = make(map[int]bool)
+	for id := 0; id < sparks; id++ {
+		runBots[id] = true
+	}
+	stateLock.Unlock()
+	// callbacks left over from before belong to nobody
+	for drained := false; !drained; {
+		select {
+		case <-mov:
+		default:
+			drained = true
+		}
+	}
+	go run.dispatch(sparks)
+	fmt.Printf("exploration %v started (%v, %v).\n", run.id, name, duration)
+	return run, nil
+}
+
+// dispatch hands /mov callbacks to policy() until the run is cancelled
+func (run *exploration) dispatch(sparks int) {
+	defer close(run.loop)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	var end <-chan time.Time
+	if run.duration > 0 {
+		timer := time.NewTimer(run.duration)
+		defer timer.Stop()
+		end = timer.C
+	}
+	// spark 'em
+	for id := 0; id < sparks; id++ {
+		run.handle(&movPostData{ID: id, Mov: "m"})
+	}
+	for {
+		select {
+		case <-run.ctx.Done():
+			return
+		case <-end:
+			// out of time, stop ourselves (stop waits on this loop, so not inline)
+			go stopExploration(run.id)
+			end = nil
+		case f := <-run.cmds:
+			f(run)
+		case mpd := <-mov:
+			run.handle(mpd)
+		case <-ticker.C:
+			fmt.Printf(".")
+			run.maybeRange()
+			run.maybeMerge()
+		}
+	}
+}
+
+// handle runs policy() for a callback, or parks it while paused or held
+func (run *exploration) handle(mpd *movPostData) {
+	if run.paused || run.held[mpd.ID] {
+		// the bot has finished its command, hold it there
+		stateLock.Lock()
+		stopMovTimer(mpd.ID)
+		stateLock.Unlock()
+		run.parked[mpd.ID] = mpd
+		fmt.Printf("  bot %v parked.\n", mpd.ID)
+		return
+	}
+	run.wg.Add(1)
+	go func() {
+		defer run.wg.Done()
+		policy(run.ctx, mpd)
+	}()
+}
+
+// do runs f on the dispatch loop, unless the run is already over
+func (run *exploration) do(f func(run *exploration)) error {
+	select {
+	case run.cmds <- f:
+		return nil
+	case <-run.loop:
+		return fmt.Errorf("exploration %v is over", run.id)
+	}
+}
+
+func (run *exploration) pause() error {
+	return run.do(func(run *exploration) {
+		run.paused = true
+		fmt.Printf("exploration %v paused.\n", run.id)
+	})
+}
+
+func (run *exploration) resume() error {
+	return run.do(func(run *exploration) {
+		run.paused = false
+		fmt.Printf("exploration %v resumed.\n", run.id)
+		for id, mpd := range run.parked {
+			if run.held[id] {
+				continue
+			}
+			delete(run.parked, id)
+			run.handle(mpd)
+		}
+	})
+}
+
+func (run *exploration) status() *runStatus {
+	rs := &runStatus{
+		ID:       run.id,
+		Policy:   run.name,
+		Started:  run.started.UnixNano() / int64(time.Millisecond),
+		Duration: run.duration.Seconds(),
+		Parked:   []int{},
+	}
+	done := make(chan struct{})
+	if run.do(func(run *exploration) {
+		rs.Running = true
+		rs.Paused = run.paused
+		for id := range run.parked {
+			rs.Parked = append(rs.Parked, id)
+		}
+		close(done)
+	}) == nil {
+		<-done
+	}
+	return rs
+}
+
+// runByID returns the current run, checking it is run id (0 matches any)
+func runByID(id int) (*exploration, error) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if current == nil {
+		return nil, fmt.Errorf("no exploration is running")
+	}
+	if id != 0 && id != current.id {
+		return nil, fmt.Errorf("exploration %v is not running (%v is)", id, current.id)
+	}
+	return current, nil
+}
+
+// stopExploration ends run id (0 for whichever is running): no more
+// callbacks are dispatched, in-flight policy() calls are waited for,
+// then every bot is told to stop where it is
+func stopExploration(id int) (*exploration, error) {
+	runLock.Lock()
+	run := current
+	if run == nil || (id != 0 && id != run.id) {
+		runLock.Unlock()
+		return nil, fmt.Errorf("exploration %v is not running", id)
+	}
+	current = nil
+	runLock.Unlock()
+
+	run.cancel()
+	<-run.loop
+	run.wg.Wait()
+	moving := haltAll()
+	stateLock.Lock()
+	for id := range botStates {
+		stopMovTimer(id)
+		paths[id] = nil
+		releaseReservations(id)
+		why := fmt.Sprintf("exploration %v stopped", run.id)
+		if moving[id] {
+			why += ", bot still stopping"
+		}
+		setState(id, stateIdle, why)
+	}
+	stateLock.Unlock()
+	fmt.Printf("exploration %v stopped.\n", run.id)
+	if err := saveMapPNG(fmt.Sprintf("map-%d.png", makeTimestamp())); err != nil {
+		fmt.Printf(" could not save map -- %v\n", err)
+	}
+	return run, nil
+}
+
+// haltAll tells every registered bot to stop its motors, in parallel, and
+// returns those that did not answer they had: a bot mid-move answers
+// "stopping" and winds down before its /mov callback
+func haltAll() map[int]bool {
+	stateLock.RLock()
+	numBots := len(bot)
+	stateLock.RUnlock()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	moving := make(map[int]bool)
+	for id := 0; id < numBots; id++ {
+		wg.Add(1)
+		go func(botID int) {
+			defer wg.Done()
+			reply, err := doMovPost(movStop, 0, botID)
+			if err == nil && strings.TrimSpace(string(reply)) == "stopped" {
+				return
+			}
+			fmt.Printf("  bot %v: not stopped yet.\n", botID)
+			lock.Lock()
+			moving[botID] = true
+			lock.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	return moving
+}
+
+// writeRun replies with the run's status as json
+func writeRun(w http.ResponseWriter, run *exploration) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run.status())
+}
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"math/cmplx"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mjibson/go-dsp/dsputils"
@@ -48,6 +51,7 @@ var (
 	clocks    []int64            // [int ID] -> millisecond start time offset
 	n         int            = 2 // total number of bots
 	localized bool           = false
+	stateLock sync.RWMutex   // guards ogm, pos, traj, paths
 )
 
 const (
@@ -144,6 +148,25 @@ type movPostData struct {
 	Mov   string  `json:"mov"`
 }
 
+// exploration request json
+//  either the whole body is a duration in seconds (default policy)
+//  or a json object naming the policy and its parameters
+type explorePostData struct {
+	Duration float64      `json:"duration"`
+	Policy   string       `json:"policy,omitempty"`
+	Params   policyParams `json:"params,omitempty"`
+}
+
+func (epd *explorePostData) parse(body []byte) error {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '{' {
+		return json.Unmarshal(body, epd)
+	}
+	d, err := strconv.ParseFloat(string(body), 64)
+	epd.Duration = d
+	return err
+}
+
 // NOTING HERE -- rotation: + is left, - is right
 
 var loc chan *locPostData
@@ -172,12 +195,28 @@ func logging(logger *log.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+// readBody reads the request body, answering 400 when it cannot
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return nil, false
+	}
+	return b, true
+}
+
+// bots that stop answering must not hang whoever is talking to them
+var botClient = &http.Client{Timeout: 10 * time.Second}
+
 func doLocPost(data string, botID int) []byte {
 	// fmt.Println(data)
 	reqBody := []byte(data)
-	resp, err := http.Post("http://"+bot[botID]+"/loc", "application/text", bytes.NewBuffer(reqBody))
+	resp, err := botClient.Post("http://"+bot[botID]+"/loc", "application/text", bytes.NewBuffer(reqBody))
 	if err != nil {
 		fmt.Printf(" doLocPost response error -- %v\n", err)
+		publishError(botID, err.Error())
+		return nil
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
@@ -193,60 +232,143 @@ const (
 	movForward  movCMD = "f"
 	movBackward movCMD = "b"
 	movRotate   movCMD = "r"
+	movStop     movCMD = "x"
 )
 
-func doMovPost(c movCMD, l int, botID int) []byte {
+// doMovPost sends botID a movement command, scaled by its calibration so
+// it moves l
+func doMovPost(c movCMD, l int, botID int) ([]byte, error) {
+	return doRawMovPost(c, calibrated(c, l, botID), botID)
+}
+
+// doMovPostAndWait sends botID a movement command and waits for its /mov
+// callback, which then does not go to the run
+func doMovPostAndWait(c movCMD, l int, botID int) (*movPostData, error) {
+	ch, err := expectMov(botID)
+	if err != nil {
+		return nil, err
+	}
+	defer forgetMov(botID, ch)
+	if _, err := doMovPost(c, l, botID); err != nil {
+		return nil, err
+	}
+	return awaitMov(botID, ch, movTimeout)
+}
+
+func doRawMovPost(c movCMD, l int, botID int) ([]byte, error) {
+	if c != movStop && isEstopped() {
+		fmt.Printf(" doMovPost refused -- %v\n", errEstopped)
+		return nil, errEstopped
+	}
 	reqBody := []byte(fmt.Sprintf("%v,%d", c, l))
-	resp, err := http.Post("http://"+bot[botID]+"/mov", "application/text", bytes.NewBuffer(reqBody))
+	resp, err := botClient.Post("http://"+bot[botID]+"/mov", "application/text", bytes.NewBuffer(reqBody))
 	if err != nil {
 		fmt.Printf(" doMovPost response error -- %v\n", err)
+		publishError(botID, err.Error())
+		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		fmt.Printf(" doMovPost body-read error -- %v\n", err)
 	}
-	return body
+	return body, err
+}
+
+func doUltPost(botID int) (float64, error) {
+	return doUltReadPost(5, botID)
 }
 
-func doUltPost(botID int) float64 {
-	reqBody := []byte("5")
-	resp, err := http.Post("http://"+bot[botID]+"/ult", "application/text", bytes.NewBuffer(reqBody))
+// doUltReadPost asks botID for the mean of samples echoes, cm
+func doUltReadPost(samples int, botID int) (float64, error) {
+	reqBody := []byte(strconv.Itoa(samples))
+	resp, err := botClient.Post("http://"+bot[botID]+"/ult", "application/text", bytes.NewBuffer(reqBody))
 	if err != nil {
 		fmt.Printf(" doUltPost response error -- %v\n", err)
+		publishError(botID, err.Error())
+		return 0, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		fmt.Printf(" doUltPost body-read error -- %v\n", err)
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	if err != nil {
+		fmt.Printf(" doUltPost parse error -- %v\n", err)
+	}
+	return f, err
+}
+
+func doBepPost(hz int, botID int) error {
+	reqBody := []byte(strconv.Itoa(hz))
+	resp, err := botClient.Post("http://"+bot[botID]+"/bep", "application/text", bytes.NewBuffer(reqBody))
+	if err != nil {
+		fmt.Printf(" doBepPost response error -- %v\n", err)
+		publishError(botID, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf(" doBepPost body-read error -- %v\n", err)
 	}
-	f, err := strconv.ParseFloat(string(body), 64)
-	// TODO handle error
-	return f
+	return err
+}
+
+// registeredBot reports whether botID has registered
+func registeredBot(botID int) bool {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	return botID >= 0 && botID < len(bot)
 }
 
 // *** MAIN LOCALIZATION PROCEDURE ***
 
-func listenAndSpeak(delayTime int64, botID int) (*locPostData, *locPostData, int64) {
+// listenAndSpeak has speaker play the tone while listener records it
+func listenAndSpeak(delayTime int64, listener, speaker int) (*locPostData, *locPostData, int64, error) {
+	acousticLock.Lock()
+	defer acousticLock.Unlock()
+	return listenAndSpeakLocked(delayTime, listener, speaker)
+}
+
+// listenAndSpeakLocked is listenAndSpeak, for callers that keep the tone to
+// themselves over several exchanges (caller must hold acousticLock)
+func listenAndSpeakLocked(delayTime int64, listener, speaker int) (*locPostData, *locPostData, int64, error) {
+	// posts left over from an exchange that timed out would pair up wrong
+	drainLoc()
 	preTime := makeTimestamp()
 	// post the listener first b/c they have more setup work to do
-	res := doLocPost(fmt.Sprintf("l,500,%v", delayTime), 0) // s0 (l == listen)
+	res := doLocPost(fmt.Sprintf("l,500,%v", delayTime), listener) // s0 (l == listen)
 	posTime := makeTimestamp()
-	// TODO -- tune
-	doLocPost(fmt.Sprintf("s,125,%v", delayTime+10), botID) // s1 (s == speak) // -((makeTimestamp()-t)+u-t1)
+	// the speaker's onset lag is taken out after, by speakerIndex
+	doLocPost(fmt.Sprintf("s,125,%v", delayTime+10), speaker) // s1 (s == speak) // -((makeTimestamp()-t)+u-t1)
 	s := strings.Split(string(res), ",")
+	if len(s) < 2 {
+		return nil, nil, 0, fmt.Errorf("bot %v did not start listening", listener)
+	}
 	l1, _ := strconv.ParseInt(s[1], 10, 64)
 	l0, _ := strconv.ParseInt(s[0], 10, 64)
 	listenerSetupTime := l1 - l0
 	// wait
-	spd0 := <-loc // speaker more likely to post back first
-	lpd0 := <-loc
+	timeout := time.After(locTimeout)
+	var posts [2]*locPostData
+	for i := range posts {
+		select {
+		case posts[i] = <-loc:
+		case <-timeout:
+			return nil, nil, 0, fmt.Errorf("bots %v and %v did not post their samples within %v", listener, speaker, locTimeout)
+		}
+	}
+	spd0 := posts[0] // speaker more likely to post back first
+	lpd0 := posts[1]
 	if lpd0.Data == "" { // potentially swap
 		tmp := lpd0
 		lpd0 = spd0
 		spd0 = tmp
 	}
-	return spd0, lpd0, (posTime - preTime - listenerSetupTime) / 2 // avg wifi flight time
+	return spd0, lpd0, (posTime - preTime - listenerSetupTime) / 2, nil // avg wifi flight time
 }
 
 func findTransformLength(m int) int {
@@ -452,16 +574,29 @@ func quadlaterate(L0, R0, L1, R1, x0, y0, x1, y1 float64) pose {
 	return pose{}
 }
 
+// forgetEstimates drops what was estimated around the old poses: covariance,
+// particles, pending ranges and the local grid frames, as loadSnapshot does
+// (caller must hold stateLock)
+func forgetEstimates() {
+	poseCovs = make(map[int]covariance)
+	filters = make(map[int]*particleFilter)
+	rangeWanted = make(map[int]bool)
+	resetLocalMaps()
+}
+
 func localize(numBots int) {
 	// assume num_bots n >= 2
 	// assume leader == 0 -- this is the bot we localize everyone relative to
 	// LOCALIZE BOT i TO BOT 0
 	var delayTime int64 = 500
+	stateLock.Lock()
 	pos = nil
 	// dDelta := 100
 	for i := 0; i < n; i++ {
 		pos = append(pos, pose{0, 0, 0}) // todo, calculate rotation
 	}
+	forgetEstimates()
+	stateLock.Unlock()
 	// main loop
 	for i := 1; i < numBots; i++ {
 		//
@@ -469,18 +604,35 @@ func localize(numBots int) {
 		//
 		dDelta := 100 // cm
 		// bot i speaks to listener 0
-		spd0, lpd0, _ := listenAndSpeak(delayTime, i) // wait
+		spd0, lpd0, _, err := listenAndSpeak(delayTime, 0, i) // wait
+		if err != nil {
+			fmt.Printf("localization aborted -- %v\n", err)
+			publishError(-1, "localization aborted: "+err.Error())
+			return
+		}
 		// listener 0 moves forward
-		doMovPost(movForward, dDelta, 0)
-		// wait
-		mpd0 := <-mov
+		mpd0, err := doMovPostAndWait(movForward, dDelta, 0)
+		if err != nil {
+			fmt.Printf("localization aborted -- %v\n", err)
+			publishError(-1, "localization aborted: "+err.Error())
+			return
+		}
 		// update 0's position (assume no drift) TODO
 		time.Sleep(time.Second * 1) // small pause
 		// bot i speaks to listener 0
-		spd1, lpd1, _ := listenAndSpeak(delayTime, i) // wait
+		spd1, lpd1, _, err := listenAndSpeak(delayTime, 0, i) // wait
+		if err != nil {
+			fmt.Printf("localization aborted -- %v\n", err)
+			publishError(-1, "localization aborted: "+err.Error())
+			return
+		}
 		// listener 0 moves back
-		doMovPost(movBackward, dDelta, 0) // TODO -- depend on mpd0
-		mpd1 := <-mov
+		mpd1, err := doMovPostAndWait(movBackward, dDelta, 0) // TODO -- depend on mpd0
+		if err != nil {
+			fmt.Printf("localization aborted -- %v\n", err)
+			publishError(-1, "localization aborted: "+err.Error())
+			return
+		}
 		//
 		// (2) CROSS-CORRELATION WITH TONE
 		//
@@ -494,28 +646,44 @@ func localize(numBots int) {
 		// idx = (STs - STm)*(len(lpdi.left)/500) (average with right?)
 		// lpdLISTENR.sOffset = idx
 		// ((t1+t2)/2)
-		lpd0.sOffset = int(((spd0.Start + clocks[i]) - (lpd0.Start + clocks[0])) * (int64(len(lpd0.left)) / lpd0.Total))
-		lpd1.sOffset = int(((spd1.Start + clocks[i]) - (lpd1.Start + clocks[0])) * (int64(len(lpd1.left)) / lpd1.Total))
+		// the tone leaves bot i's speaker its onset later (see onset.go)
+		onset := calibrationOf(i).OnsetMs
+		lpd0.sOffset = speakerIndex(lpd0, spd0, 0, i, onset)
+		lpd1.sOffset = speakerIndex(lpd1, spd1, 0, i, onset)
 		dL0 := xcorr(tone, lpd0.left, lpd0.sOffset)
 		dR0 := xcorr(tone, lpd0.right, lpd0.sOffset)
 		dL1 := xcorr(tone, lpd1.left, lpd1.sOffset)
 		dR1 := xcorr(tone, lpd1.right, lpd1.sOffset)
 		// assume bot 0 does not drift left/right (x-pos)
+		stateLock.Lock()
 		pos[1] = quadlaterate(dL0, dR0, dL1, dR1, pos[0].x, pos[0].y, pos[0].x+0, pos[0].y+(mpd0.Start-mpd0.End))
 		// pos[0].x = // TODO
 		pos[0].y += (mpd0.Start - mpd0.End) + (mpd1.Start - mpd1.End)
 		// fmt.Println(clocks)
 		// fmt.Printf("speaker index starts:\n %v\t%v\n", lpd0.sOffset, lpd1.sOffset)
 		fmt.Printf("attempted to localize %v to leader\n positions: %v\n", i, pos)
+		// bot 0 moved and bot i jumped, start their estimates over
+		forgetEstimates()
+		publishFix(i, "localize")
+		stateLock.Unlock()
+	}
+}
+
+// localizeLimit is the most bots POST /localize takes: n, and no more than
+// have registered (caller must hold stateLock)
+func localizeLimit() int {
+	if len(bot) < n {
+		return len(bot)
 	}
+	return n
 }
 
 // *** MAIN EXPLORATION PROCEDURE ***
 
 var (
 	paths     [][]cell          // [botID] -> the path (list) to take
-	botjobs   map[int]bool      // ids to bool
-	botids    map[cell]int      // cords to id
+	botjobs   map[int]bool      // ids to bool (holds a goal, see auctionPolicy)
+	botids    map[cell]int      // cords to id (goal -> bot holding it)
 	xscale    float64      = 10 // centimeters per cell
 	yscale    float64      = 10 // centimeters per cell
 	occThresh float64      = 2
@@ -526,59 +694,6 @@ func binPose(p pose) cell {
 	return cell{x: int(p.x / xscale), y: int(p.y / yscale)}
 }
 
-func generatePath(start cell, hashList map[cell]cell, origin cell) []cell { // hashList : child -> parent
-	list := make([]cell, 0)
-	curr := start
-	next := hashList[curr]
-	for curr != origin {
-		// list = append([]cell{key}, list...) // it's a forward trajectory
-		list = append(list, curr)
-		curr = next
-		next = hashList[next]
-	}
-	return list // head == bot
-}
-
-type bfsQNode struct {
-	node     cell
-	cameFrom cell
-}
-
-func expand(path []cell) [][]cell {
-	neighbors := [][]cell{}
-	for a := -1; a < 2; a++ {
-		for b := -1; b < 2; b++ {
-			if a != 0 || b != 0 {
-				neighbors = append(neighbors, append([]cell{cell{x: path[0].x + a, y: path[0].y + b}}, path...))
-			}
-		}
-	}
-	return neighbors
-}
-
-func bfs(origin cell, botID int) {
-	fmt.Printf("BFS(%v) -> %v (%v)\n", origin, binPose(pos[botID]), pos[botID])
-	Q := make([][]cell, 0)
-	visited := make(map[cell]bool) // cell positions we have expanded already
-	botCell := binPose(pos[botID])
-	Q = append(Q, []cell{origin}) // spark
-	for len(Q) > 0 {
-		path := Q[0]         // obtain top of queue
-		node := path[0]      // get node on path
-		Q = Q[1:]            // behead
-		if botCell == node { // is this the goal?
-			// found bot, update trajectory
-			fmt.Println("found bot!")
-			paths[botID] = path
-			fmt.Printf("%v -> %v -> %v\n", botCell, paths[botID], origin)
-			break
-		} else if !visited[node] && math.Abs(ogm[node]) < occThresh {
-			visited[node] = true
-			Q = append(Q, expand(path)...)
-		}
-	}
-}
-
 func calculateRotation(botID int) int {
 	/*
 		eg:
@@ -590,8 +705,10 @@ func calculateRotation(botID int) int {
 	ydelta := botCell.y - paths[botID][0].y
 	// rot := (math.Atan((float64(ydelta) / float64(xdelta))) * 180 / math.Pi) - (pos[botID].r + 90)
 	rot := ((math.Atan2(float64(ydelta), float64(xdelta)) * 180 / math.Pi) + 180)
-	fmt.Printf(" calculated rotation: %v\n", rot-pos[botID].r)
-	return int(rot - pos[botID].r)
+	// turn the short way round
+	rot = math.Mod(rot-pos[botID].r+540, 360) - 180
+	fmt.Printf(" calculated rotation: %v\n", rot)
+	return int(rot)
 	// // make a box of of where each neighbor is
 	// // 1 2 3
 	// // 8   4
@@ -654,11 +771,13 @@ func sign(n int) int {
 	return 1
 }
 
-func updateOGM(s cell, e cell) {
+// updateGrid marks e occupied and the cells from s up to it free in g,
+// returning the cells it changed
+func updateGrid(g map[cell]float64, s cell, e cell) []cell {
 	// [start,end) == zero
 	// end == 1
 	// occupied ogm update rule:
-	ogm[e] += math.Log(odds / (1 - odds))
+	g[e] += math.Log(odds / (1 - odds))
 	// y = mx+b
 	i := cell{x: s.x, y: s.y}
 	dx := e.x - s.x
@@ -682,8 +801,10 @@ func updateOGM(s cell, e cell) {
 			seen[cell{x: int(float64(i) * step), y: int(m*float64(i)*step + b)}] = true
 		}
 	}
+	touched := []cell{e}
 	for k := range seen {
-		ogm[k] += math.Log((1 - odds) / odds)
+		g[k] += math.Log((1 - odds) / odds)
+		touched = append(touched, k)
 	}
 	// deltaOGM := float64(lcm(int(c.x-b.x), int(c.y-b.y)))
 	// if deltaOGM < 0 {
@@ -701,130 +822,160 @@ func updateOGM(s cell, e cell) {
 	// 	}
 	// }
 	// fmt.Println(seen)
+	return touched
 }
 
-func policy(mpd *movPostData) {
-	// update current pose
-	pos[mpd.ID].r += mpd.Rot // degrees
-	for pos[mpd.ID].r > 360 {
-		pos[mpd.ID].r -= 360
+func policy(ctx context.Context, mpd *movPostData) {
+	stateLock.Lock()
+	if mpd.ID < 0 || mpd.ID >= len(pos) || mpd.ID >= len(traj) || mpd.ID >= len(botStates) || mpd.ID >= len(paths) {
+		// not a bot this run can move
+		stateLock.Unlock()
+		fmt.Printf("  bot %v: ignoring /mov, no pose.\n", mpd.ID)
+		return
 	}
-	d := mpd.Start - mpd.End
-	pos[mpd.ID].x += d * math.Cos(pos[mpd.ID].r*math.Pi/180) // sin/cos input radians
-	pos[mpd.ID].y += d * math.Sin(pos[mpd.ID].r*math.Pi/180)
+	stopMovTimer(mpd.ID)
+	state := botStates[mpd.ID]
+	switch state {
+	case stateSensing, statePlanning:
+		// already handling a callback, this one is a duplicate
+		stateLock.Unlock()
+		fmt.Printf("  bot %v: ignoring /mov while %v.\n", mpd.ID, state)
+		return
+	case stateFailed:
+		fmt.Printf("  bot %v answered after all, recovering.\n", mpd.ID)
+	}
+	// update current pose (and how sure we are of it)
+	// the move is measured by the ultrasonic, the turn is the bot's belief
+	activeEstimator.Predict(mpd.ID, turned(mpd.Rot, mpd.ID), mpd.Start-mpd.End)
+	checkUncertainty(mpd.ID)
 	// save current pose to "real" trajectory
 	// fmt.Println(traj)
 	traj[mpd.ID] = append(traj[mpd.ID], pos[mpd.ID])
+	publish(evPose, mpd.ID, map[string]interface{}{"pose": pos[mpd.ID], "step": len(traj[mpd.ID]) - 1})
 	// fmt.Println(traj[mpd.ID])
 	// fmt.Printf("  want to go to %v, am at %v (global %v)\n", paths[mpd.ID][0], binPose(pos[mpd.ID]), pos[mpd.ID])
 	// plan new actions
-	if mpd.Mov == "r" {
-		// update current rotation
-		// pos[mpd.ID].r = pos[mpd.ID].r + mpd.Rot
-		// tell bot to move forward
+	if state == stateRotating {
+		// facing the next waypoint, tell bot to move forward
 		dist := math.Sqrt(math.Pow(pos[mpd.ID].x-xscale*float64(paths[mpd.ID][0].x), 2) + math.Pow(pos[mpd.ID].y-yscale*float64(paths[mpd.ID][0].y), 2))
-		// move forward
-		fmt.Printf("  asking to move forward %v cm.\n", dist)
-		doMovPost(movForward, int(dist), mpd.ID)
 		// remove from trajectory
 		paths[mpd.ID] = paths[mpd.ID][1:]
-	} else {
-		// take measurement
-		d := doUltPost(mpd.ID)
-		// partially account for ultrasonic max cm distance
-		if d > 500 {
-			d = math.Min(d, doUltPost(mpd.ID))
-		}
-		if d > 500 {
-			d = 500
+		stateLock.Unlock()
+		// move forward
+		fmt.Printf("  asking to move forward %v cm.\n", dist)
+		sendMov(ctx, mpd.ID, movForward, int(dist), stateMoving)
+		return
+	}
+	// moved, backed off or got re-sparked: take measurement
+	setState(mpd.ID, stateSensing, "measuring")
+	stateLock.Unlock()
+	d, err := doUltPost(mpd.ID)
+	// partially account for ultrasonic max cm distance
+	if err == nil && d > 500 {
+		if d2, err2 := doUltPost(mpd.ID); err2 == nil {
+			d = math.Min(d, d2)
 		}
-		// upate OGM based on current pose
-		fmt.Println("updating OGM.")
-		// fmt.Println(d)
-		// TODO CHECK
-		c := pose{x: d*math.Cos(pos[mpd.ID].r*math.Pi/180) + pos[mpd.ID].x, y: d*math.Sin(pos[mpd.ID].r*math.Pi/180) + pos[mpd.ID].y}
-		cc := binPose(c)
-		// fmt.Println(c)
-		// update all OGM values along path (use (1-odds)/odds for occupancy evidence of zero!)
-		// 1 / lcm( ending grid position - starting grid position )
-		b := pos[mpd.ID]
-		bb := binPose(b)
-		// fmt.Println(b)
-		updateOGM(bb, cc)
-		// new point?
-		if len(paths[mpd.ID]) == 0 {
-			// return // uncomment when you want a single trajectory you establish
-			fmt.Println("choosing new trajectory.")
-			paths[mpd.ID] = nil // not needed?
-			// select new point (POLICY -- we're doing some random/greedy policy here)
-			// -- pick K random cell points
-			// -- do BFS from point K_i to bot -> yield trajectory
-			// -- select shortest trajectory that minimizes sum(abs(occupancy)) value
-			//   -- sort by total occ
-			//   -- of best L < K, choose shortest path
-			// -> output goal point
-			// TODO
-			randCells := make([]cell, 0)
-			K := 10
-			// b := binPose(pos[mpd.ID])
-			for i := 0; i < K; i++ {
-				xDelta := rand.Intn(2) + 1
-				yDelta := rand.Intn(2) + 1
-				if rand.Intn(2)%2 == 0 {
-					xDelta *= -1
-				}
-				if rand.Intn(2)%2 == 0 {
-					yDelta *= -1
-				}
-				randCells = append(randCells, cell{bb.x + xDelta, bb.y + yDelta})
-			}
-			minIdx := 0
-			for i := 0; i < len(randCells); i++ {
-				if math.Abs(ogm[randCells[i]]) < math.Abs(ogm[randCells[minIdx]]) {
-					minIdx = i
-				}
+	}
+	if d > 500 {
+		d = 500
+	}
+	stateLock.Lock()
+	if err != nil {
+		failBot(mpd.ID, "ultrasonic: "+err.Error())
+		stateLock.Unlock()
+		return
+	}
+	publish(evUltrasonic, mpd.ID, map[string]float64{"z": d})
+	// correct the pose against the map so far, before the reading goes into it
+	activeEstimator.Measure(mpd.ID, d)
+	// upate OGM based on current pose
+	fmt.Println("updating OGM.")
+	// fmt.Println(d)
+	// TODO CHECK
+	c := pose{x: d*math.Cos(pos[mpd.ID].r*math.Pi/180) + pos[mpd.ID].x, y: d*math.Sin(pos[mpd.ID].r*math.Pi/180) + pos[mpd.ID].y}
+	cc := binPose(c)
+	// fmt.Println(c)
+	// update all OGM values along path (use (1-odds)/odds for occupancy evidence of zero!)
+	// 1 / lcm( ending grid position - starting grid position )
+	b := pos[mpd.ID]
+	bb := binPose(b)
+	// fmt.Println(b)
+	// through the bot's own grid, so the ogm is always the grids merged
+	touched := updateLocalMap(mpd.ID, d)
+	cvs := make([]cellValue, 0, len(touched))
+	for _, t := range touched {
+		cvs = append(cvs, cellValue{X: t.x, Y: t.y, L: ogm[t]})
+	}
+	publish(evOGM, mpd.ID, cvs)
+	activePolicy.OnMeasurement(mpd.ID, bb, cc)
+	setState(mpd.ID, statePlanning, fmt.Sprintf("%v waypoints left", len(paths[mpd.ID])))
+	// new point?
+	unreachable := false
+	if len(paths[mpd.ID]) == 0 {
+		// return // uncomment when you want a single trajectory you establish
+		fmt.Println("choosing new trajectory.")
+		paths[mpd.ID] = nil // not needed?
+		// select new point (POLICY -- see policies)
+		// a policy may hand out unreachable goals, give it a few tries
+		for attempt := 0; attempt < planAttempts; attempt++ {
+			goal, ok := activePolicy.NextGoal(mpd.ID, bb)
+			if !ok {
+				break
 			}
 			// calculate new trajectory
-			bfs(randCells[minIdx], mpd.ID) // void, will update botID's path
-		} // else, continue on same trajectory
-		// then tell bot to rotate
-		fmt.Println("  sending rotation->move command.")
-		doMovPost(movRotate, calculateRotation(mpd.ID), mpd.ID)
-	}
-}
-
-func explore(expTime float64) {
-	if !localized {
-		// assume the bots are localized:
-		// and are pointing forward
-		pos = append(pos, []pose{pose{0, 0, 90}, pose{127, 0, 90}, pose{0, 127, 90}}...)
-		// example trajectory
-		// paths[0] = []cell{cell{0, 1}, cell{1, 0}, cell{0, -1}, cell{-1, 0}, cell{0, 1}, cell{0, 0}}
-		localized = true
-	}
-	ticker := time.NewTicker(1 * time.Second)
-	done := make(chan bool)
-	go func() {
-		// spark 'em
-		mov <- &movPostData{ID: 0, Mov: "m"}
-		mov <- &movPostData{ID: 1, Mov: "m"}
-		// mov <- &movPostData{ID: 2, Mov: "m"}
-		for {
-			select {
-			case <-done:
-				return
-			case mpd := <-mov:
-				go policy(mpd)
-			case <-ticker.C:
-				fmt.Printf(".")
+			path, err := plan(bb, goal, mpd.ID)
+			if err != nil {
+				fmt.Printf("  bot %v: %v\n", mpd.ID, err)
+				activePolicy.OnPlanFailed(mpd.ID, goal)
+				unreachable = true
+				continue
 			}
+			paths[mpd.ID] = smoothPath(bb, path, mpd.ID)
+			reservePath(mpd.ID, bb, paths[mpd.ID])
+			publish(evPlan, mpd.ID, map[string]interface{}{"goal": goal, "path": append([]cell{}, paths[mpd.ID]...)})
+			fmt.Printf("  bot %v: %v -> %v\n", mpd.ID, bb, paths[mpd.ID])
+			break
 		}
-	}()
-	time.Sleep(time.Duration(expTime) * time.Second)
-	done <- true
-	// fmt.Println(traj)
-	printOGM()
-	printTraj()
+	} // else, continue on same trajectory
+	if len(paths[mpd.ID]) == 0 {
+		releaseReservations(mpd.ID)
+		if other, ok := nearestRobot(mpd.ID, headOnCells); ok {
+			// boxed in by another bot rather than by the map
+			setState(mpd.ID, stateBlocked, fmt.Sprintf("boxed in by bot %v", other))
+			stateLock.Unlock()
+			if yields(mpd.ID, other) {
+				sendMov(ctx, mpd.ID, movBackward, backoffDist, stateMoving)
+			} else {
+				retryLater(ctx, mpd.ID)
+			}
+			return
+		}
+		if unreachable {
+			// the map may open up, or the policy find other goals
+			setState(mpd.ID, stateBlocked, "no path")
+			stateLock.Unlock()
+			retryLater(ctx, mpd.ID)
+			return
+		}
+		// nothing left to do, bot stays put
+		setState(mpd.ID, stateIdle, "nothing to do")
+		stateLock.Unlock()
+		return
+	}
+	if other, ok := headOn(mpd.ID); ok && yields(mpd.ID, other) {
+		// deadlock, give way and plan again from further back
+		setState(mpd.ID, stateBlocked, fmt.Sprintf("head-on with bot %v", other))
+		paths[mpd.ID] = nil
+		releaseReservations(mpd.ID)
+		stateLock.Unlock()
+		sendMov(ctx, mpd.ID, movBackward, backoffDist, stateMoving)
+		return
+	}
+	rot := calculateRotation(mpd.ID)
+	stateLock.Unlock()
+	// then tell bot to rotate
+	fmt.Println("  sending rotation->move command.")
+	sendMov(ctx, mpd.ID, movRotate, rot, stateRotating)
 }
 
 func printOGM() {
@@ -892,6 +1043,54 @@ func printTraj() {
 // *** MAIN SERVER ***
 
 func main() {
+	loadFile := flag.String("load", "", "resume from a snapshot `file` written by a previous run")
+	snapFile := flag.String("snapshot", "snapshot.json", "`file` to snapshot the map, trajectories and bots to")
+	snapEvery := flag.Duration("snapshot-every", 30*time.Second, "snapshot period (0 only snapshots on shutdown)")
+	flag.DurationVar(&rangeEvery, "range-every", rangeEvery, "how often an exploration pauses two bots to range between them acoustically (0 only when a bot needs relocalizing)")
+	flag.DurationVar(&mergeEvery, "merge-every", mergeEvery, "how often an exploration lines the bots' own grids up and rebuilds the map from them (0 only on POST /map/merge)")
+	flag.Float64Var(&robotRadius, "robot-radius", robotRadius, "cm the planner keeps the bots off walls")
+	flag.Float64Var(&unknownCost, "unknown-cost", unknownCost, "how many times dearer the planner makes a step through unknown cells (at least 1)")
+	flag.StringVar(&defaultEstimator, "estimator", defaultEstimator, "pose estimator ("+estimatorNames()+")")
+	flag.StringVar(&defaultPolicy, "policy", defaultPolicy, "exploration policy when /explore does not name one ("+policyNames()+")")
+	flag.StringVar(&defaultPolicy, "goal", defaultPolicy, "same as -policy, its old name")
+	recordFile := flag.String("record", "", "record the run to `file`, for -eval")
+	evalFile := flag.String("eval", "", "score the run recorded in `file` against -truth and exit, instead of serving")
+	truthFile := flag.String("truth", "", "ground truth `file` for -eval and -simulate: the bots' true poses and the walls")
+	simFile := flag.String("simulate", "", "drive simulated bots through the -truth poses, record the run to `file` for -eval and exit, instead of serving")
+	simSeed := flag.Int64("simulate-seed", 1, "seed of the -simulate noise, the same seed gives the same run")
+	reportFile := flag.String("report", "", "also write the -eval report to `file` as json")
+	flag.DurationVar(&evalEvery, "eval-every", evalEvery, "how often through the run -eval scores the map (0 only at the end)")
+	flag.IntVar(&evalTolerance, "eval-tolerance", evalTolerance, "cells a wall may be off by and still count for -eval")
+	flag.Parse()
+	if *evalFile != "" {
+		if err := runEval(*evalFile, *truthFile, *reportFile); err != nil {
+			log.Fatalf("could not evaluate: %v\n", err)
+		}
+		return
+	}
+	if _, ok := policies[defaultPolicy]; !ok {
+		log.Fatalf("unknown policy %q\n", defaultPolicy)
+	}
+	if unknownCost < 1 || robotRadius < 0 {
+		log.Fatalf("-unknown-cost must be >= 1 and -robot-radius >= 0\n")
+	}
+	if e, ok := estimators[defaultEstimator]; ok {
+		activeEstimator = e
+	} else {
+		log.Fatalf("unknown estimator %q\n", defaultEstimator)
+	}
+	if *simFile != "" {
+		if err := runSimulation(*simFile, *truthFile, *simSeed); err != nil {
+			log.Fatalf("could not simulate: %v\n", err)
+		}
+		log.Printf("recorded the simulated run to %v\n", *simFile)
+		return
+	}
+	spec, err := loadSpec(openapiJSON)
+	if err != nil {
+		log.Fatalf("bad openapi.json: %v\n", err)
+	}
+
 	// OGM setup
 	log.Println("Localization and Mapping setup.")
 	ogm = make(map[cell]float64)
@@ -907,12 +1106,19 @@ func main() {
 	botjobs = make(map[int]bool)
 	botids = make(map[cell]int)
 
+	if *loadFile != "" {
+		if err := loadSnapshot(*loadFile); err != nil {
+			log.Fatalf("could not load snapshot: %v\n", err)
+		}
+		log.Printf("  resumed %v bots and %v cells from %v\n", len(bot), len(ogm), *loadFile)
+	}
+
 	// http setup
 	log.Println("Starting server.")
 	// option to run port on a given input argument
 	port := 42
-	if len(os.Args) > 1 {
-		port, _ = strconv.Atoi(os.Args[1])
+	if flag.NArg() > 0 {
+		port, _ = strconv.Atoi(flag.Arg(0))
 	}
 	log.Printf("  server will run on port %v\n", port)
 
@@ -923,6 +1129,26 @@ func main() {
 	//   set up endpoint stop
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// ctrl-c / docker stop shut down the same way as /end
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	if *snapEvery > 0 {
+		go snapshotLoop(ctx, *snapFile, *snapEvery)
+	}
+	// the recording outlives the server, so it has the shutdown too
+	recCtx, stopRecording := context.WithCancel(context.Background())
+	defer stopRecording()
+	var recorded <-chan struct{}
+	if *recordFile != "" {
+		if recorded, err = startRecording(recCtx, *recordFile); err != nil {
+			log.Fatalf("could not record: %v\n", err)
+		}
+		log.Printf("  recording to %v\n", *recordFile)
+	}
 	// MAIN SERVER ENDPOINT HANDLERS
 	router.HandleFunc("/end", func(w http.ResponseWriter, r *http.Request) {
 		// w.Header().Set("Content-Type", "application/json")
@@ -935,14 +1161,16 @@ func main() {
 		log.Println("Someone wants to register...")
 		switch r.Method {
 		case "POST":
-			reqBodyBytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				log.Fatal(err)
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
 			}
 			reqBody := &regPostData{}
-			err = json.Unmarshal(reqBodyBytes, reqBody)
-			if err != nil {
-				log.Fatal(err)
+			err := json.Unmarshal(reqBodyBytes, reqBody)
+			if err != nil || reqBody.IP == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid registration!\n"))
+				return
 			}
 			log.Printf("  %v\n", reqBody)
 			// see if ip has registered already
@@ -958,13 +1186,16 @@ func main() {
 				newID = len(bot)
 				newIP := reqBody.IP
 				log.Printf("  %v -> %v\n", newID, newIP)
+				stateLock.Lock()
 				bot = append(bot, newIP)
 				remote[r.RemoteAddr] = newID
 				clocks = append(clocks, t-reqBody.Clock) // move calculation up?
 				paths = append(paths, []cell{})
 				traj = append(traj, []pose{})
+				botStates = append(botStates, stateIdle)
+				stateLock.Unlock()
 			}
-
+			publish(evRegister, newID, map[string]interface{}{"id": newID, "ip": reqBody.IP})
 			w.Write([]byte(strconv.Itoa(newID)))
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
@@ -991,15 +1222,23 @@ func main() {
 		// }
 		switch r.Method {
 		case "POST":
-			reqBodyBytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				fmt.Println(err)
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
 			}
 			// log.Println(string(reqBodyBytes))
 			reqBody := &locPostData{}
-			err = json.Unmarshal(reqBodyBytes, reqBody)
+			err := json.Unmarshal(reqBodyBytes, reqBody)
 			if err != nil {
 				fmt.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			if !registeredBot(reqBody.ID) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("no bot %v\n", reqBody.ID)))
+				return
 			}
 			// fmt.Println(reqBody.left)
 			// fmt.Println(reqBody.right)
@@ -1013,17 +1252,26 @@ func main() {
 	router.HandleFunc("/mov", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
-			reqBodyBytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				fmt.Println(err)
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
 			}
 			log.Println(string(reqBodyBytes))
 			reqBody := &movPostData{}
-			err = json.Unmarshal(reqBodyBytes, reqBody)
+			err := json.Unmarshal(reqBodyBytes, reqBody)
 			if err != nil {
 				fmt.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error() + "\n"))
+				return
 			}
-			mov <- reqBody
+			if !registeredBot(reqBody.ID) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("no bot %v\n", reqBody.ID)))
+				return
+			}
+			publish(evMov, reqBody.ID, *reqBody)
+			deliverMov(reqBody)
 			w.Write([]byte(`thanks!`))
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
@@ -1041,24 +1289,294 @@ func main() {
 	})
 	router.HandleFunc("/localize", func(w http.ResponseWriter, r *http.Request) {
 		// eg: POST "3" will localize the first three bots relative to 0
-		reqBodyBytes, err := ioutil.ReadAll(r.Body)
-		numBots, err := strconv.Atoi(string(reqBodyBytes))
-		if err != nil || numBots < 2 || numBots > n || numBots > len(bot) {
-			w.Write([]byte("invalid bot!\n"))
-		} else {
+		switch r.Method {
+		case "POST":
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+			numBots, err := strconv.Atoi(strings.TrimSpace(string(reqBodyBytes)))
+			stateLock.RLock()
+			limit := localizeLimit()
+			stateLock.RUnlock()
+			if err != nil || numBots < 2 || numBots > limit {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid bot!\n"))
+				return
+			}
 			go localize(numBots)
 			w.Write([]byte("performing localization.\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
 		}
 	})
-	router.HandleFunc("/explore", func(w http.ResponseWriter, r *http.Request) {
-		// eg: POST "3" will explore for 3 seconds
-		reqBodyBytes, err := ioutil.ReadAll(r.Body)
-		expTime, err := strconv.ParseFloat(string(reqBodyBytes), 64)
-		if err != nil || expTime < 0 { // or not localized...
-			w.Write([]byte("invalid exploration time!\n"))
-		} else {
-			go explore(expTime)
-			w.Write([]byte("explorin'\n"))
+	exploreStart := func(w http.ResponseWriter, r *http.Request) {
+		// eg: POST "3" will explore for 3 seconds with the default policy
+		//     POST {"duration":3,"policy":"frontier","params":{"lambda":0.2}}
+		//     a duration of 0 explores until /explore/stop
+		switch r.Method {
+		case "POST":
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+			reqBody := &explorePostData{}
+			err := reqBody.parse(reqBodyBytes)
+			if err != nil || reqBody.Duration < 0 { // or not localized...
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid exploration time!\n"))
+				return
+			}
+			p, err := newPolicy(reqBody.Policy, reqBody.Params)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			name := reqBody.Policy
+			if name == "" {
+				name = defaultPolicy
+			}
+			run, err := startExploration(time.Duration(reqBody.Duration*float64(time.Second)), name, p)
+			if err != nil {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			writeRun(w, run)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	}
+	// the other /explore/ endpoints take an optional run id, eg: POST "2"
+	exploreControl := func(control func(id int) (*exploration, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST":
+				reqBodyBytes, ok := readBody(w, r)
+				if !ok {
+					return
+				}
+				id := 0
+				if body := strings.TrimSpace(string(reqBodyBytes)); body != "" {
+					var err error
+					if id, err = strconv.Atoi(body); err != nil || id < 1 {
+						w.WriteHeader(http.StatusBadRequest)
+						w.Write([]byte("invalid exploration id!\n"))
+						return
+					}
+				}
+				run, err := control(id)
+				if err != nil {
+					w.WriteHeader(http.StatusConflict)
+					w.Write([]byte(err.Error() + "\n"))
+					return
+				}
+				writeRun(w, run)
+			default:
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+			}
+		}
+	}
+	router.HandleFunc("/explore", exploreStart) // old name of /explore/start
+	router.HandleFunc("/explore/start", exploreStart)
+	router.HandleFunc("/explore/pause", exploreControl(func(id int) (*exploration, error) {
+		run, err := runByID(id)
+		if err != nil {
+			return nil, err
+		}
+		return run, run.pause()
+	}))
+	router.HandleFunc("/explore/resume", exploreControl(func(id int) (*exploration, error) {
+		run, err := runByID(id)
+		if err != nil {
+			return nil, err
+		}
+		return run, run.resume()
+	}))
+	router.HandleFunc("/explore/stop", exploreControl(stopExploration))
+	router.HandleFunc("/explore/status", func(w http.ResponseWriter, r *http.Request) {
+		run, err := runByID(0)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		writeRun(w, run)
+	})
+	router.HandleFunc("/estop", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			emergencyStop()
+			w.Write([]byte("stopped. POST /estop/clear to move again.\n"))
+		case "GET":
+			if isEstopped() {
+				w.Write([]byte("engaged\n"))
+			} else {
+				w.Write([]byte("clear\n"))
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/estop/clear", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			clearEstop()
+			w.Write([]byte("cleared.\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/uncertainty", func(w http.ResponseWriter, r *http.Request) {
+		writeUncertainty(w)
+	})
+	router.HandleFunc("/uncertainty/noise", func(w http.ResponseWriter, r *http.Request) {
+		// eg: POST {"id":0,"rot":0.03,"rotbase":1,"fwd":0.1,"fwdbase":2,"drift":0.02}
+		//     fields left out keep their current value
+		switch r.Method {
+		case "POST":
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+			reqBody := &struct {
+				ID *int `json:"id"`
+			}{}
+			err := json.Unmarshal(reqBodyBytes, reqBody)
+			stateLock.Lock()
+			if err != nil || reqBody.ID == nil || *reqBody.ID < 0 || *reqBody.ID >= len(bot) {
+				stateLock.Unlock()
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid bot!\n"))
+				return
+			}
+			mn := noiseOf(*reqBody.ID)
+			if err := json.Unmarshal(reqBodyBytes, &mn); err != nil {
+				stateLock.Unlock()
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			noises[*reqBody.ID] = mn
+			stateLock.Unlock()
+			w.Write([]byte("noted.\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/relocalize", func(w http.ResponseWriter, r *http.Request) {
+		// eg: POST "1" has the estimator find bot 1 again
+		switch r.Method {
+		case "POST":
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+			botID, err := strconv.Atoi(strings.TrimSpace(string(reqBodyBytes)))
+			stateLock.Lock()
+			defer stateLock.Unlock()
+			if err != nil || botID < 0 || botID >= len(bot) || botID >= len(pos) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid bot!\n"))
+				return
+			}
+			if err := activeEstimator.Relocalize(botID); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			w.Write([]byte("relocalizing.\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/map/merge", func(w http.ResponseWriter, r *http.Request) {
+		// line the bots' own grids up against each other now
+		switch r.Method {
+		case "POST":
+			writeMerge(w)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// the mux sends every unknown path here too
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	router.HandleFunc("/dashboard/state", streamDashboard)
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		// eg: GET /events?type=mov,ogm streams only those
+		switch r.Method {
+		case "GET":
+			streamEvents(w, r)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/bots", handleBots)
+	router.HandleFunc("/bots/", handleBot)
+	router.HandleFunc("/map", handleMap)
+	router.HandleFunc("/localization", handleLocalization)
+	router.HandleFunc("/diagnostics", handleDiagnostics)
+	router.HandleFunc("/calibration", handleCalibrations)
+	router.HandleFunc("/beep", func(w http.ResponseWriter, r *http.Request) {
+		// eg: POST "1" beeps bot 1 at the ranging tone, POST "1,440" at 440 Hz
+		switch r.Method {
+		case "POST":
+			reqBodyBytes, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+			s := strings.Split(strings.TrimSpace(string(reqBodyBytes)), ",")
+			botID, err := strconv.Atoi(s[0])
+			hz := tone
+			if err == nil && len(s) > 1 {
+				hz, err = strconv.Atoi(s[1])
+			}
+			stateLock.RLock()
+			numBots := len(bot)
+			stateLock.RUnlock()
+			if err != nil || botID < 0 || botID >= numBots || hz <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid bot!\n"))
+				return
+			}
+			if err := doBepPost(hz, botID); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			w.Write([]byte("beeped.\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+		}
+	})
+	router.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		// the document requests are checked against
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openapiJSON)
+	})
+	router.HandleFunc("/map.png", func(w http.ResponseWriter, r *http.Request) {
+		// occupancy grid with trajectories, poses and planned paths overlaid
+		w.Header().Set("Content-Type", "image/png")
+		if err := writeMapPNG(w); err != nil {
+			log.Println(err)
 		}
 	})
 	// TODO -- send robot trajectory, then robot gives us log of what happened
@@ -1085,7 +1603,7 @@ func main() {
 	// })
 	server := &http.Server{
 		Addr:    ":" + strconv.Itoa(port),
-		Handler: logging(logger)(router),
+		Handler: logging(logger)(recovering(validating(spec)(router))),
 	}
 
 	// spawn http server thread
@@ -1108,5 +1626,15 @@ func main() {
 		}
 	} // no default case needed
 
+	if err := saveSnapshot(*snapFile); err != nil {
+		log.Println(err)
+	} else {
+		log.Printf("saved snapshot to %v\n", *snapFile)
+	}
+	if recorded != nil {
+		stopRecording()
+		<-recorded
+		log.Printf("recorded to %v\n", *recordFile)
+	}
 	log.Printf("server closed.")
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// *** SIMULATION ***
+
+// -simulate writes a recording for -eval without any bots: each bot of
+// -truth drives through its truth poses while the server's estimator and
+// grids take it in, so a change can be scored before it meets the room
+//  -- a bot's first pose is where it starts, each later one a move there:
+//     turn to face it, drive, turn to its heading
+//  -- the server hears each move as a bot would report it, off by the
+//     bot's motion noise (see motion.go)
+//  -- after each move the ultrasonic reads along the true heading to the
+//     nearest wall, off by ultSigma and capped at ultMax as policy caps it
+//  -- the server's frame is -truth's frame, or wherever bot 0 starts
+//  -- a pose is recorded at its step (one per move from 0, unless the
+//     truth gives it) and its time (the truth's, or simStep after the last)
+
+var simStep int64 = 1000 // ms between moves the truth gives no time for
+
+// simBot is one bot of the truth being driven
+type simBot struct {
+	id    int
+	poses []truthPose
+	next  int // the pose it drives to next
+	t     int64
+}
+
+// runSimulation drives the bots of truthFile and records it to runFile
+func runSimulation(runFile, truthFile string, seed int64) error {
+	if truthFile == "" {
+		return fmt.Errorf("-simulate needs -truth")
+	}
+	truth, err := readTruth(truthFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(runFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return simulate(json.NewEncoder(f), truth, rand.New(rand.NewSource(seed)))
+}
+
+// simulate writes the events of truth's run to enc (caller must hold
+// stateLock)
+func simulate(enc *json.Encoder, truth *groundTruth, rng *rand.Rand) error {
+	bots := []*simBot{}
+	numBots := 0
+	var t0 int64 = math.MaxInt64
+	for _, tb := range truth.Bots {
+		if tb.ID < 0 {
+			return fmt.Errorf("bot %v: no such bot", tb.ID)
+		}
+		if len(tb.Poses) == 0 {
+			continue
+		}
+		for _, tp := range tb.Poses {
+			if tp.Time > 0 && tp.Time < t0 {
+				t0 = tp.Time
+			}
+		}
+		bots = append(bots, &simBot{id: tb.ID, poses: tb.Poses, next: 1})
+		if tb.ID >= numBots {
+			numBots = tb.ID + 1
+		}
+	}
+	if len(bots) == 0 {
+		return fmt.Errorf("the truth has no poses to drive through")
+	}
+	if t0 == math.MaxInt64 {
+		t0 = simStep
+	}
+	frame := room(bots[0].poses[0])
+	for _, b := range bots {
+		if b.id == 0 {
+			frame = room(b.poses[0])
+		}
+	}
+	if truth.Frame != nil {
+		frame = *truth.Frame
+	}
+
+	// a fresh server with the bots where the truth starts them
+	ogm = make(map[cell]float64)
+	bot = make([]string, numBots)
+	pos = make([]pose, numBots)
+	traj = make([][]pose, numBots)
+	paths = make([][]cell, numBots)
+	botStates = make([]botState, numBots)
+	clocks = make([]int64, numBots)
+	poseCovs = make(map[int]covariance)
+	filters = make(map[int]*particleFilter)
+	rangeWanted = make(map[int]bool)
+	for _, b := range bots {
+		pos[b.id] = relative(frame, room(b.poses[0]))
+		b.t = t0
+		if b.poses[0].Time > 0 {
+			b.t = b.poses[0].Time
+		}
+	}
+	localized = true
+	resetLocalMaps()
+
+	var id int64
+	write := func(typ string, t int64, botID *int, data interface{}) error {
+		id++
+		return enc.Encode(event{ID: id, Type: typ, Time: t, Bot: botID, Data: data})
+	}
+	s := takeSnapshot()
+	s.Time = t0
+	if err := write("snapshot", t0, nil, s); err != nil {
+		return err
+	}
+	for _, b := range bots {
+		botID := b.id
+		if err := write(evLocalization, b.t, &botID, poseFix{Source: "simulate", Pose: pos[botID], SigmaXY: positionSigma(botID)}); err != nil {
+			return err
+		}
+	}
+	for {
+		// the bot whose next move comes first
+		sort.SliceStable(bots, func(i, j int) bool { return moveTime(bots[i]) < moveTime(bots[j]) })
+		b := bots[0]
+		if b.next >= len(b.poses) {
+			return nil
+		}
+		from, to := room(b.poses[b.next-1]), room(b.poses[b.next])
+		t := moveTime(b)
+		if t < b.t {
+			return fmt.Errorf("bot %v: pose %v is before the one it follows", b.id, b.next)
+		}
+		step := b.next - 1
+		if tp := b.poses[b.next]; tp.Step != nil {
+			step = *tp.Step
+		}
+		b.next, b.t = b.next+1, t
+		botID := b.id
+
+		// drive there, as the bot reports it
+		mn := noiseOf(botID)
+		rot1, d, rot2 := 0.0, math.Hypot(to.x-from.x, to.y-from.y), angleDiff(to.r, from.r)
+		if d > 0 {
+			heading := math.Atan2(to.y-from.y, to.x-from.x) * 180 / math.Pi
+			rot1, rot2 = angleDiff(heading, from.r), angleDiff(to.r, heading)
+		}
+		rot1 += rng.NormFloat64() * (mn.RotPer*math.Abs(rot1) + mn.RotBase)
+		rot2 += rng.NormFloat64() * (mn.RotPer*math.Abs(rot2) + mn.RotBase + mn.DriftPer*d)
+		d += rng.NormFloat64() * (mn.FwdPer*d + mn.FwdBase)
+		activeEstimator.Predict(botID, rot1, d)
+		activeEstimator.Predict(botID, rot2, 0)
+		traj[botID] = append(traj[botID], pos[botID])
+		if err := write(evPose, t, &botID, map[string]interface{}{"pose": pos[botID], "step": step}); err != nil {
+			return err
+		}
+
+		// and read the ultrasonic
+		z := math.Min(wallRange(truth.Walls, to)+rng.NormFloat64()*ultSigma, ultMax)
+		z = math.Max(z, 0)
+		if err := write(evUltrasonic, t, &botID, map[string]float64{"z": z}); err != nil {
+			return err
+		}
+		activeEstimator.Measure(botID, z)
+		touched := updateLocalMap(botID, z)
+		cvs := make([]cellValue, 0, len(touched))
+		for _, c := range touched {
+			cvs = append(cvs, cellValue{X: c.x, Y: c.y, L: ogm[c]})
+		}
+		if err := write(evOGM, t, &botID, cvs); err != nil {
+			return err
+		}
+	}
+}
+
+// moveTime is when b makes its next move, past every other move when it
+// has none left
+func moveTime(b *simBot) int64 {
+	if b.next >= len(b.poses) {
+		return math.MaxInt64
+	}
+	if t := b.poses[b.next].Time; t > 0 {
+		return t
+	}
+	return b.t + simStep
+}
+
+// room is the pose of tp
+func room(tp truthPose) pose {
+	return pose{x: tp.X, y: tp.Y, r: tp.R}
+}
+
+// wallRange is how far p is from the nearest wall straight ahead, ultMax
+// when there is none that close
+func wallRange(walls []wall, p pose) float64 {
+	th := p.r * math.Pi / 180
+	dx, dy := math.Cos(th), math.Sin(th)
+	best := ultMax
+	for _, w := range walls {
+		// p + t*(dx, dy) == w0 + u*(w1 - w0), 0 <= u <= 1
+		ex, ey := w.X1-w.X0, w.Y1-w.Y0
+		den := dx*ey - dy*ex
+		if den == 0 {
+			continue // parallel
+		}
+		qx, qy := w.X0-p.x, w.Y0-p.y
+		t := (qx*ey - qy*ex) / den
+		u := (qx*dy - qy*dx) / den
+		if t >= 0 && u >= 0 && u <= 1 && t < best {
+			best = t
+		}
+	}
+	return best
+}
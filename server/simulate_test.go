@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// box is a square room of side cm
+func box(side float64) []wall {
+	return []wall{
+		{X0: 0, Y0: 0, X1: side, Y1: 0},
+		{X0: side, Y0: 0, X1: side, Y1: side},
+		{X0: side, Y0: side, X1: 0, Y1: side},
+		{X0: 0, Y0: side, X1: 0, Y1: 0},
+	}
+}
+
+func TestWallRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		walls []wall
+		p     pose
+		want  float64
+	}{
+		{name: "east", walls: box(300), p: pose{100, 100, 0}, want: 200},
+		{name: "north", walls: box(300), p: pose{100, 100, 90}, want: 200},
+		{name: "west", walls: box(300), p: pose{100, 100, 180}, want: 100},
+		{name: "corner", walls: box(300), p: pose{100, 100, 225}, want: 100 * math.Sqrt2},
+		{name: "too far", walls: box(1000), p: pose{100, 100, 0}, want: ultMax},
+		{name: "no walls", p: pose{100, 100, 0}, want: ultMax},
+		{name: "behind", walls: []wall{{X0: 50, Y0: 0, X1: 50, Y1: 200}}, p: pose{100, 100, 0}, want: ultMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wallRange(tt.walls, tt.p); math.Abs(got-tt.want) > 1e-6 {
+				t.Fatalf("wallRange = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	defer func(m map[cell]float64, b []string, p []pose, tr [][]pose, ps [][]cell, bs []botState, cl []int64, l bool, e Estimator, us float64, mn map[int]motionNoise) {
+		ogm, bot, pos, traj, paths, botStates, clocks, localized, activeEstimator, ultSigma, noises = m, b, p, tr, ps, bs, cl, l, e, us, mn
+		poseCovs = make(map[int]covariance)
+		filters = make(map[int]*particleFilter)
+		rangeWanted = make(map[int]bool)
+		resetLocalMaps()
+	}(ogm, bot, pos, traj, paths, botStates, clocks, localized, activeEstimator, ultSigma, noises)
+	// nothing off, so the run is the truth
+	activeEstimator, ultSigma = odometryEstimator{}, 0
+	noises = map[int]motionNoise{0: {}, 1: {}}
+
+	step := func(i int) *int { return &i }
+	truth := &groundTruth{
+		Walls: box(300),
+		Bots: []truthBot{
+			{ID: 0, Poses: []truthPose{
+				{X: 50, Y: 50, R: 90},
+				{Step: step(0), X: 50, Y: 150, R: 90},
+				{Step: step(1), X: 150, Y: 150, R: 0},
+				{Step: step(2), X: 150, Y: 150, R: 270},
+				// a second look, one reading is no wall yet
+				{Step: step(3), X: 150, Y: 150, R: 270},
+			}},
+			{ID: 1, Poses: []truthPose{
+				{X: 250, Y: 50, R: 180},
+				{Step: step(0), X: 250, Y: 250, R: 90},
+			}},
+		},
+	}
+	var buf bytes.Buffer
+	stateLock.Lock()
+	err := simulate(json.NewEncoder(&buf), truth, rand.New(rand.NewSource(1)))
+	stateLock.Unlock()
+	if err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	dir := t.TempDir()
+	runFile, truthFile := filepath.Join(dir, "run.jsonl"), filepath.Join(dir, "truth.json")
+	if err := os.WriteFile(runFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(truth)
+	if err := os.WriteFile(truthFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := evaluate(runFile, truthFile)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if len(r.Bots) != 2 || r.Bots[0].Matched != 4 || r.Bots[1].Matched != 1 {
+		t.Fatalf("evaluate matched %+v, want every step", r.Bots)
+	}
+	if r.ATE > 1e-6 || r.RPETrans > 1e-6 {
+		t.Fatalf("evaluate ATE %v RPE %v, want a perfect run", r.ATE, r.RPETrans)
+	}
+	if r.Map == nil || r.Map.Occupied == 0 || r.Map.Precision < 1 {
+		t.Fatalf("evaluate map %+v, want every reading on a wall", r.Map)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// *** PATH SMOOTHING ***
+
+// each waypoint costs the bot an "r" then an "f" round trip (and some
+// rotation error), so planned paths are compressed before dispatch
+
+var maxSegment float64 = 150 // cm, longest single forward move we send
+
+// lineCells returns the cells a straight line from a to b passes through,
+// including both orthogonal neighbors wherever it crosses a cell corner
+func lineCells(a, b cell) []cell {
+	cells := []cell{a}
+	steps := 4 * int(math.Max(math.Abs(float64(b.x-a.x)), math.Abs(float64(b.y-a.y))))
+	prev := a
+	for i := 1; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		c := cell{
+			x: int(math.Round(float64(a.x) + t*float64(b.x-a.x))),
+			y: int(math.Round(float64(a.y) + t*float64(b.y-a.y))),
+		}
+		if c == prev {
+			continue
+		}
+		if c.x != prev.x && c.y != prev.y {
+			// diagonal step, the robot sweeps both side cells too
+			cells = append(cells, cell{x: c.x, y: prev.y}, cell{x: prev.x, y: c.y})
+		}
+		cells = append(cells, c)
+		prev = c
+	}
+	return cells
+}
+
+// mergeCollinear drops every waypoint that continues in the direction of
+// the previous step
+func mergeCollinear(start cell, path []cell) []cell {
+	if len(path) < 2 {
+		return path
+	}
+	merged := []cell{}
+	prev := start
+	for i := 0; i < len(path)-1; i++ {
+		d0 := cell{x: path[i].x - prev.x, y: path[i].y - prev.y}
+		d1 := cell{x: path[i+1].x - path[i].x, y: path[i+1].y - path[i].y}
+		if d0 != d1 {
+			merged = append(merged, path[i])
+		}
+		prev = path[i]
+	}
+	return append(merged, path[len(path)-1])
+}
+
+// shortcutPath replaces runs of waypoints with a straight segment whenever
+// the robot can drive it directly: no inflated obstacle in the way, and no
+// unknown cell the planned path did not already go through
+func shortcutPath(start cell, path []cell, blocked map[cell]bool) []cell {
+	onPath := map[cell]bool{start: true}
+	for _, c := range path {
+		onPath[c] = true
+	}
+	// the dense path is needed to tell which unknown cells were planned through
+	for _, c := range densePath(start, path) {
+		onPath[c] = true
+	}
+	drivable := func(a, b cell) bool {
+		for _, c := range lineCells(a, b) {
+			if c == start {
+				continue
+			}
+			if blocked[c] || (isUnknown(c) && !onPath[c]) {
+				return false
+			}
+		}
+		return true
+	}
+	short := []cell{}
+	anchor := start
+	for i := 0; i < len(path); {
+		// furthest waypoint we can see from the anchor
+		j := i
+		for k := len(path) - 1; k > i; k-- {
+			if drivable(anchor, path[k]) {
+				j = k
+				break
+			}
+		}
+		short = append(short, path[j])
+		anchor = path[j]
+		i = j + 1
+	}
+	return short
+}
+
+// splitLong breaks segments longer than maxSegment into equal pieces
+func splitLong(start cell, path []cell) []cell {
+	split := []cell{}
+	prev := start
+	for _, c := range path {
+		length := euclDist(float64(prev.x)*xscale, float64(prev.y)*yscale, float64(c.x)*xscale, float64(c.y)*yscale)
+		pieces := int(math.Ceil(length / maxSegment))
+		for i := 1; i < pieces; i++ {
+			t := float64(i) / float64(pieces)
+			split = append(split, cell{
+				x: int(math.Round(float64(prev.x) + t*float64(c.x-prev.x))),
+				y: int(math.Round(float64(prev.y) + t*float64(c.y-prev.y))),
+			})
+		}
+		split = append(split, c)
+		prev = c
+	}
+	return split
+}
+
+// smoothPath compresses botID's planned path into few, long segments
+// (caller must hold stateLock)
+func smoothPath(start cell, path []cell, botID int) []cell {
+	blocked := planBlocked(botID)
+	short := shortcutPath(start, mergeCollinear(start, path), blocked)
+	short = splitLong(start, short)
+	fmt.Printf("  smoothed %v cells into %v waypoints.\n", len(path), len(short))
+	return short
+}
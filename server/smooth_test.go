@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeCollinear(t *testing.T) {
+	tests := []struct {
+		name  string
+		start cell
+		path  []cell
+		want  []cell
+	}{
+		{name: "empty", path: []cell{}, want: []cell{}},
+		{name: "one step", path: []cell{{1, 0}}, want: []cell{{1, 0}}},
+		{name: "straight", path: []cell{{1, 0}, {2, 0}, {3, 0}}, want: []cell{{3, 0}}},
+		{name: "corner", path: []cell{{1, 0}, {2, 0}, {2, 1}, {2, 2}}, want: []cell{{2, 0}, {2, 2}}},
+		{name: "diagonal", path: []cell{{1, 1}, {2, 2}, {3, 2}}, want: []cell{{2, 2}, {3, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeCollinear(tt.start, tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("mergeCollinear = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShortcutPath(t *testing.T) {
+	defer func(m map[cell]float64) { ogm = m }(ogm)
+
+	// an L round the corner of a block
+	around := []cell{{1, 0}, {2, 0}, {3, 0}, {3, 1}, {3, 2}, {3, 3}}
+	tests := []struct {
+		name    string
+		free    [2]cell
+		blocked []cell
+		path    []cell
+		want    []cell
+	}{
+		{
+			name: "open room",
+			free: [2]cell{{0, 0}, {3, 3}},
+			path: around,
+			want: []cell{{3, 3}},
+		},
+		{
+			name:    "around a block",
+			free:    [2]cell{{0, 0}, {3, 3}},
+			blocked: []cell{{1, 1}, {1, 2}, {2, 1}, {2, 2}},
+			path:    around,
+			want:    []cell{{3, 0}, {3, 3}},
+		},
+		{
+			name: "not through unknown",
+			free: [2]cell{{0, 0}, {3, 0}},
+			path: around,
+			want: []cell{{3, 0}, {3, 3}},
+		},
+		{
+			name: "through unknown it planned through",
+			free: [2]cell{{0, 0}, {0, 0}},
+			path: []cell{{1, 0}, {2, 0}, {3, 0}},
+			want: []cell{{3, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			knownFree(ogm, tt.free[0], tt.free[1])
+			knownFree(ogm, cell{3, 0}, cell{3, 3})
+			blocked := make(map[cell]bool)
+			for _, c := range tt.blocked {
+				blocked[c] = true
+			}
+			if got := shortcutPath(cell{0, 0}, tt.path, blocked); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("shortcutPath = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitLong(t *testing.T) {
+	defer func(m float64) { maxSegment = m }(maxSegment)
+	maxSegment = 150
+
+	tests := []struct {
+		name string
+		path []cell
+		want []cell
+	}{
+		{name: "short", path: []cell{{10, 0}}, want: []cell{{10, 0}}},
+		{name: "twice as long", path: []cell{{20, 0}}, want: []cell{{10, 0}, {20, 0}}},
+		{name: "a bit over", path: []cell{{16, 0}}, want: []cell{{8, 0}, {16, 0}}},
+		{name: "each segment", path: []cell{{0, 45}, {10, 45}}, want: []cell{{0, 15}, {0, 30}, {0, 45}, {10, 45}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitLong(cell{0, 0}, tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitLong = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSmoothPath(t *testing.T) {
+	defer func(m map[cell]float64, p []pose, b []string, rr float64) {
+		ogm, pos, bot, robotRadius = m, p, b, rr
+	}(ogm, pos, bot, robotRadius)
+	pos, bot, robotRadius = nil, nil, 0
+
+	// a planned path round a wall and on down a long corridor
+	path := []cell{{1, 0}, {2, 0}, {3, 0}, {3, 1}, {3, 2}, {3, 3}}
+	for y := 4; y <= 20; y++ {
+		path = append(path, cell{3, y})
+	}
+	tests := []struct {
+		name  string
+		walls []cell
+		want  []cell
+	}{
+		{name: "open", want: []cell{{2, 10}, {3, 20}}},
+		{name: "round the wall", walls: []cell{{0, 2}, {1, 2}, {2, 2}}, want: []cell{{3, 0}, {3, 10}, {3, 20}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ogm = make(map[cell]float64)
+			knownFree(ogm, cell{0, 0}, cell{3, 20})
+			for _, w := range tt.walls {
+				ogm[w] = 2 * occThresh
+			}
+			if got := smoothPath(cell{0, 0}, path, 0); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("smoothPath = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}